@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+type testDelivery struct {
+	From string
+	To   string
+	Data string
+}
+
+type testResult struct {
+	Destination string
+	Mx          string
+	Tls         string
+	Delivered   bool
+	Response    string
+}
+
+// adminAuth lets through requests carrying token as a bearer token.
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || given == header || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// testDeliver resolves and delivers a sample message to an arbitrary
+// address and reports which MX and TLS version were used and what the
+// upstream answered.
+func testDeliver(host string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req testDelivery
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.Contains(req.To, "@") {
+			http.Error(w, "need a json body with a To address", http.StatusBadRequest)
+			return
+		}
+
+		if req.From == "" {
+			req.From = "postmaster@" + host
+		}
+		if req.Data == "" {
+			req.Data = "From: <" + req.From + ">\r\n" +
+				"To: <" + req.To + ">\r\n" +
+				"Subject: relayd test delivery\r\n" +
+				"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+				"\r\n" +
+				"Test delivery from " + host + ".\r\n"
+		}
+
+		result := testResult{Destination: req.To}
+		ix := strings.LastIndex(req.To, "@")
+		mailhosts := []string{smart_host}
+		var err error
+		if smart_host == "" {
+			var hosts []string
+			hosts, err = getMX(req.To[ix+1:])
+			mailhosts = nil
+			for _, host := range hosts {
+				mailhosts = append(mailhosts, host+":smtp")
+			}
+		}
+
+		if err == nil && len(mailhosts) == 0 {
+			result.Response = "no mx found"
+		} else if err != nil {
+			result.Response = err.Error()
+		} else {
+			trace := &deliveryTrace{}
+			err = deliverMX(req.From, req.To, []byte(req.Data), mailhosts, trace)
+			result.Mx = trace.Host
+			result.Tls = trace.Tls
+			result.Delivered = err == nil
+			result.Response = "250 accepted"
+			if tpErr, ok := err.(*textproto.Error); ok {
+				result.Response = tpErr.Error()
+			} else if err != nil {
+				result.Response = err.Error()
+			}
+		}
+
+		log.Println("admin test delivery to "+req.To+":", result.Response)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func tlsStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Inbound":  tls_inbound.Summary(),
+		"Outbound": tls_outbound.Summary(),
+	})
+}
+
+func usageStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage.Snapshot())
+}
+
+func acceptAliases(aliases *AliasSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"Accepted": aliases.AcceptPending()})
+	}
+}
+
+// listQuarantine shows the messages held for review.
+func listQuarantine(q *Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		items, err := q.Quarantined()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	}
+}
+
+// settleQuarantine applies settle, Release or Discard, to the quarantined
+// item named by the id parameter.
+func settleQuarantine(settle func(id string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if err := settle(id); err == errNotQuarantined {
+			http.Error(w, "no quarantined item "+id, http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("failed to settle quarantined item "+id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	}
+}
+
+func startAdmin(bind string, token string, host string, aliases *AliasSet, q *Queue) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test-deliver", adminAuth(token, testDeliver(host)))
+	mux.HandleFunc("/tls-stats", adminAuth(token, tlsStats))
+	mux.HandleFunc("/usage", adminAuth(token, usageStats))
+	mux.HandleFunc("/accept-aliases", adminAuth(token, acceptAliases(aliases)))
+	if q != nil {
+		mux.HandleFunc("/quarantine", adminAuth(token, listQuarantine(q)))
+		mux.HandleFunc("/quarantine/release", adminAuth(token, settleQuarantine(q.Release)))
+		mux.HandleFunc("/quarantine/delete", adminAuth(token, settleQuarantine(q.Discard)))
+	}
+
+	log.Println("admin listening on " + bind)
+	go func() {
+		log.Fatal(http.ListenAndServe(bind, mux))
+	}()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUsageEndpoint(t *testing.T) {
+	defer func(store *UsageStore) { usage = store }(usage)
+	var err error
+	if usage, err = readUsage(filepath.Join(t.TempDir(), "usage.json")); err != nil {
+		t.Fatal(err)
+	}
+	usage.Record("acme", 100)
+
+	handler := adminAuth("secret", usageStats)
+
+	response := httptest.NewRecorder()
+	handler(response, httptest.NewRequest("GET", "/usage", nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("usage without a token answered %d, want 401", response.Code)
+	}
+
+	request := httptest.NewRequest("GET", "/usage", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	handler(response, request)
+
+	var tenants map[string]Usage
+	if err = json.NewDecoder(response.Body).Decode(&tenants); err != nil {
+		t.Fatal(err)
+	}
+	if tenants["acme"] != (Usage{Messages: 1, Bytes: 100}) {
+		t.Errorf("usage endpoint reported %+v for acme, want 1 message and 100 bytes", tenants["acme"])
+	}
+}
+
+func TestTestDeliverEndpoint(t *testing.T) {
+	defer func(host string) { smart_host = host }(smart_host)
+	handler := adminAuth("secret", testDeliver("relay.example.net"))
+
+	post := func(body string) testResult {
+		request := httptest.NewRequest("POST", "/test-deliver", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("test-deliver answered %d: %s", response.Code, response.Body)
+		}
+		var result testResult
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	upstream := newFakeUpstream(t)
+	smart_host = upstream.Addr()
+	result := post(`{"To": "partner@example.org"}`)
+	if !result.Delivered || result.Mx != upstream.Addr() || result.Tls != "none" || result.Response != "250 accepted" {
+		t.Errorf("test delivery reported %+v, want it delivered via %s in cleartext", result, upstream.Addr())
+	}
+	messages := upstream.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "Subject: relayd test delivery") {
+		t.Errorf("upstream received %q, want the sample message", messages)
+	}
+	if !hasCommand(upstream.Commands(), "MAIL FROM:<postmaster@relay.example.net>") {
+		t.Errorf("upstream got %q, want the sample sent from postmaster", upstream.Commands())
+	}
+
+	rejecting := newFakeUpstream(t)
+	rejecting.respond = func(line string) string {
+		if strings.HasPrefix(line, "RCPT") {
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	}
+	smart_host = rejecting.Addr()
+	result = post(`{"To": "nobody@example.org", "From": "ops@example.com"}`)
+	if result.Delivered || !strings.HasPrefix(result.Response, "550") || !strings.Contains(result.Response, "5.1.1 No such user") {
+		t.Errorf("test delivery to a rejected address reported %+v, want the upstream's 550", result)
+	}
+
+	request := httptest.NewRequest("POST", "/test-deliver", strings.NewReader(`{"To": "partner@example.org"}`))
+	response := httptest.NewRecorder()
+	handler(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("test-deliver without a token answered %d, want 401", response.Code)
+	}
+}
+
+func TestAdminAuthNeedsBearerToken(t *testing.T) {
+	handler := adminAuth("secret", func(w http.ResponseWriter, r *http.Request) {})
+	for header, code := range map[string]int{
+		"Bearer secret":  http.StatusOK,
+		"secret":         http.StatusUnauthorized,
+		"Bearer secrets": http.StatusUnauthorized,
+		"Basic secret":   http.StatusUnauthorized,
+		"":               http.StatusUnauthorized,
+	} {
+		request := httptest.NewRequest("GET", "/usage", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != code {
+			t.Errorf("Authorization %q answered %d, want %d", header, response.Code, code)
+		}
+	}
+
+	open := adminAuth("", func(w http.ResponseWriter, r *http.Request) {})
+	request := httptest.NewRequest("GET", "/usage", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	response := httptest.NewRecorder()
+	open(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("empty admin token let a request through with %d", response.Code)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AliasBackend struct {
+	Url     string
+	Aliases []Alias
+	Err     error
+	Fetched time.Time
+	Pending []Alias
+
+	backoff time.Duration
+	retry   *time.Timer
+}
+
+// AliasSet guards its backends' tables with mutex: refreshes swap in whole
+// new tables under the write lock, and lookups read them under the read
+// lock. A table is never modified once fetched.
+type AliasSet struct {
+	Backends []*AliasBackend
+	mutex    sync.RWMutex
+
+	// Strategy is "first" or "merge"; Defer makes an unavailable backend
+	// defer the lookup rather than fall through to the next one.
+	Strategy string
+	Defer    bool
+
+	// MaxStale is how long a backend may keep serving its last good table;
+	// past it StaleDefer defers all mail for that backend.
+	MaxStale   time.Duration
+	StaleDefer bool
+
+	// Postmaster receives postmaster@ mail for any local domain that has no
+	// postmaster alias. Local domains are Domains plus every alias domain;
+	// a Postmaster in one of them isn't used, since mail to it would loop.
+	Postmaster string
+	Domains    []string
+
+	// MaxChange is the percentage of entries a reload may change before it
+	// is held back; Webhook is notified when that happens.
+	MaxChange float64
+	Webhook   string
+
+	// A failed fetch is retried after a backoff that doubles from five
+	// seconds up to RetryMax, on top of the regular refresh.
+	RetryMax time.Duration
+}
+
+// RefreshBackend fetches a backend's table. On failure, including a table
+// with no entries, the previous table is kept, the error recorded and a retry
+// scheduled. A table changing more than MaxChange percent of the entries is
+// held as pending until accepted with AcceptPending.
+func (set *AliasSet) RefreshBackend(backend *AliasBackend) {
+	aliases, err := fetchEmailAliases(backend.Url)
+	if err == nil && len(aliases) == 0 {
+		err = errors.New("alias table has no entries")
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	backend.Err = err
+	if err != nil {
+		log.Printf("failed to fetch aliases from %s, keeping %d previous entries: %v", backend.Url, len(backend.Aliases), err)
+		set.scheduleRetry(backend)
+		return
+	}
+
+	backend.backoff = 0
+	if backend.retry != nil {
+		backend.retry.Stop()
+		backend.retry = nil
+	}
+
+	if set.MaxChange > 0 && len(backend.Aliases) > 0 {
+		changes := aliasChanges(backend.Aliases, aliases)
+		percent := float64(changes) * 100 / float64(len(backend.Aliases))
+		if percent > set.MaxChange {
+			log.Printf("ALERT: alias table from %s changes %d of %d entries (%.1f%%), keeping previous table until accepted", backend.Url, changes, len(backend.Aliases), percent)
+			backend.Pending = aliases
+			alias_reloads_held.WithLabelValues(metricsSource(backend.Url)).Inc()
+			go notifyChange(set.Webhook, backend.Url, changes, len(backend.Aliases), percent)
+			return
+		}
+	}
+
+	backend.Aliases = aliases
+	backend.Pending = nil
+	backend.Fetched = time.Now()
+}
+
+func (set *AliasSet) scheduleRetry(backend *AliasBackend) {
+	if set.RetryMax <= 0 {
+		return
+	}
+	if backend.retry != nil {
+		backend.retry.Stop()
+	}
+
+	if backend.backoff == 0 {
+		backend.backoff = 5 * time.Second
+	} else {
+		backend.backoff *= 2
+	}
+	if backend.backoff > set.RetryMax {
+		backend.backoff = set.RetryMax
+	}
+
+	log.Printf("retrying alias fetch from %s in %v", backend.Url, backend.backoff)
+	backend.retry = time.AfterFunc(backend.backoff, func() {
+		set.RefreshBackend(backend)
+	})
+}
+
+// AcceptPending installs tables held back by the change threshold.
+func (set *AliasSet) AcceptPending() int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	accepted := 0
+	for _, backend := range set.Backends {
+		if backend.Pending != nil {
+			log.Printf("accepting pending alias table from %s with %d entries", backend.Url, len(backend.Pending))
+			backend.Aliases = backend.Pending
+			backend.Pending = nil
+			backend.Fetched = time.Now()
+			accepted++
+		}
+	}
+	return accepted
+}
+
+// aliasChanges counts entries added, removed or pointed elsewhere between
+// two tables.
+func aliasChanges(before []Alias, after []Alias) int {
+	old := make(map[string]string)
+	for _, alias := range before {
+		old[alias.Source] = strings.Join(alias.Destinations, ",")
+	}
+	updated := make(map[string]string)
+	for _, alias := range after {
+		updated[alias.Source] = strings.Join(alias.Destinations, ",")
+	}
+
+	changes := 0
+	for source, dest := range updated {
+		if prev, ok := old[source]; !ok || prev != dest {
+			changes++
+		}
+	}
+	for source := range old {
+		if _, ok := updated[source]; !ok {
+			changes++
+		}
+	}
+	return changes
+}
+
+func notifyChange(webhook string, url string, changes int, entries int, percent float64) {
+	if webhook == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"Backend": url,
+		"Changes": changes,
+		"Entries": entries,
+		"Percent": percent,
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("alias change webhook failed", err)
+		return
+	}
+	response.Body.Close()
+}
+
+func (set *AliasSet) Refresh() {
+	set.mutex.RLock()
+	backends := set.Backends
+	set.mutex.RUnlock()
+
+	for _, backend := range backends {
+		set.RefreshBackend(backend)
+
+		set.mutex.RLock()
+		if set.stale(backend) {
+			log.Printf("alias table from %s is stale, last fetched %v", backend.Url, backend.Fetched)
+		}
+		set.mutex.RUnlock()
+	}
+}
+
+// Reconfigure replaces the backend list with urls and sets RetryMax.
+// Backends that are kept hold on to their tables; new ones are empty until
+// the next refresh.
+func (set *AliasSet) Reconfigure(urls []string, retryMax time.Duration) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	existing := make(map[string]*AliasBackend)
+	for _, backend := range set.Backends {
+		existing[backend.Url] = backend
+	}
+
+	var backends []*AliasBackend
+	for _, url := range urls {
+		backend, ok := existing[url]
+		if !ok {
+			log.Println("adding alias backend " + url)
+			backend = &AliasBackend{Url: url}
+		}
+		delete(existing, url)
+		backends = append(backends, backend)
+	}
+	for url, backend := range existing {
+		log.Println("removing alias backend " + url)
+		if backend.retry != nil {
+			backend.retry.Stop()
+		}
+	}
+
+	set.Backends = backends
+	set.RetryMax = retryMax
+}
+
+// Health reports why the alias set can't be trusted to route mail: a
+// backend whose last fetch failed, whose table is empty, or whose table is
+// older than maxAge.
+func (set *AliasSet) Health(maxAge time.Duration) error {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	for _, backend := range set.Backends {
+		if backend.Err != nil {
+			return errors.New("alias fetch failed for " + metricsSource(backend.Url))
+		}
+		if len(backend.Aliases) == 0 {
+			return errors.New("alias table empty for " + metricsSource(backend.Url))
+		}
+		if maxAge > 0 && time.Since(backend.Fetched) > maxAge {
+			return errors.New("alias table stale for " + metricsSource(backend.Url))
+		}
+	}
+	return nil
+}
+
+// Missing returns the backends that have never had a table.
+func (set *AliasSet) Missing() []*AliasBackend {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	var missing []*AliasBackend
+	for _, backend := range set.Backends {
+		if backend.Aliases == nil {
+			missing = append(missing, backend)
+		}
+	}
+	return missing
+}
+
+// stale and isPostmaster expect the caller to hold the read lock.
+func (set *AliasSet) stale(backend *AliasBackend) bool {
+	return set.MaxStale > 0 && backend.Aliases != nil && time.Since(backend.Fetched) > set.MaxStale
+}
+
+// Lookup consults the backends in precedence order. With the "first"
+// strategy the first match wins, with "merge" every backend's match is
+// returned. A backend with no table, or a table past MaxStale when
+// StaleDefer is set, defers the lookup with a temporary error.
+func (set *AliasSet) Lookup(recipient string) ([]Alias, error) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	var found []Alias
+	expired := false
+
+	for _, backend := range set.Backends {
+		if backend.Aliases == nil && backend.Err != nil {
+			if set.Defer {
+				log.Println("deferring "+recipient+", alias backend unavailable", backend.Url)
+				return nil, smtpd.Error{Code: 451, Message: "4.3.0 Alias backend unavailable"}
+			}
+			continue
+		}
+
+		if set.StaleDefer && set.stale(backend) {
+			log.Println("deferring "+recipient+", alias table is stale", backend.Url)
+			return nil, smtpd.Error{Code: 451, Message: "4.3.0 Alias table is stale"}
+		}
+
+		alias, err := getAlias(backend.Aliases, recipient)
+		if err == errAliasExpired {
+			expired = true
+		}
+		if err != nil {
+			continue
+		}
+
+		found = append(found, alias)
+		if set.Strategy != "merge" {
+			break
+		}
+	}
+
+	if len(found) == 0 && set.Postmaster != "" && set.isPostmaster(recipient) {
+		// a postmaster in a local domain would route back to relayd
+		if set.isLocal(set.Postmaster[strings.LastIndex(set.Postmaster, "@")+1:]) {
+			log.Println("not routing " + recipient + " to Postmaster " + set.Postmaster + ", which is in a local domain")
+		} else {
+			return []Alias{{Source: recipient, Destinations: []string{set.Postmaster}}}, nil
+		}
+	}
+
+	if len(found) == 0 && expired {
+		return nil, errAliasExpired
+	}
+
+	if len(found) == 0 {
+		return nil, errors.New("recipient not found in alias table")
+	}
+
+	return found, nil
+}
+
+func (set *AliasSet) isPostmaster(recipient string) bool {
+	ix := strings.LastIndex(recipient, "@")
+	if ix < 0 || !strings.EqualFold(recipient[:ix], "postmaster") {
+		return false
+	}
+	return set.isLocal(recipient[ix+1:])
+}
+
+// isLocal reports whether relayd accepts mail for domain.
+func (set *AliasSet) isLocal(domain string) bool {
+	for _, local := range set.Domains {
+		if strings.EqualFold(local, domain) {
+			return true
+		}
+	}
+
+	for _, backend := range set.Backends {
+		for _, alias := range backend.Aliases {
+			if strings.HasSuffix(strings.ToLower(alias.Source), "@"+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// domainAllowed reports whether domain is in allowed, or whether allowed is
+// empty and every domain is.
+func domainAllowed(allowed []string, domain string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, domain) {
+			return true
+		}
+	}
+	return false
+}
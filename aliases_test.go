@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBackend(url string, aliases ...Alias) *AliasBackend {
+	return &AliasBackend{Url: url, Aliases: aliases, Fetched: time.Now()}
+}
+
+func destinations(found []Alias) []string {
+	var all []string
+	for _, alias := range found {
+		all = append(all, alias.Destinations...)
+	}
+	return all
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	set := &AliasSet{
+		Strategy: "first",
+		Backends: []*AliasBackend{
+			testBackend("primary", Alias{Source: "info@example.com", Destinations: []string{"primary@example.org"}}),
+			testBackend("secondary",
+				Alias{Source: "info@example.com", Destinations: []string{"secondary@example.org"}},
+				Alias{Source: "sales@example.com", Destinations: []string{"sales@example.org"}}),
+		},
+	}
+
+	found, err := set.Lookup("info@example.com")
+	if err != nil || len(found) != 1 || found[0].Destinations[0] != "primary@example.org" {
+		t.Errorf("first strategy found %v, %v, want only the primary backend's alias", destinations(found), err)
+	}
+
+	found, err = set.Lookup("sales@example.com")
+	if err != nil || len(found) != 1 || found[0].Destinations[0] != "sales@example.org" {
+		t.Errorf("lookup missing from the primary found %v, %v, want the secondary's alias", destinations(found), err)
+	}
+}
+
+func TestLookupMerge(t *testing.T) {
+	set := &AliasSet{
+		Strategy: "merge",
+		Backends: []*AliasBackend{
+			testBackend("primary", Alias{Source: "info@example.com", Destinations: []string{"primary@example.org"}}),
+			testBackend("secondary", Alias{Source: "info@example.com", Destinations: []string{"secondary@example.org"}}),
+		},
+	}
+
+	found, err := set.Lookup("info@example.com")
+	got := destinations(found)
+	if err != nil || len(got) != 2 || got[0] != "primary@example.org" || got[1] != "secondary@example.org" {
+		t.Errorf("merge strategy found %v, %v, want both backends' destinations in order", got, err)
+	}
+}
+
+func TestLookupUnavailableBackend(t *testing.T) {
+	down := &AliasBackend{Url: "primary", Err: errors.New("connection refused")}
+	fallback := testBackend("secondary", Alias{Source: "info@example.com", Destinations: []string{"secondary@example.org"}})
+
+	set := &AliasSet{Strategy: "first", Defer: true, Backends: []*AliasBackend{down, fallback}}
+	_, err := set.Lookup("info@example.com")
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 451 {
+		t.Errorf("lookup with the primary down and Defer set: got %v, want a 451", err)
+	}
+
+	set.Defer = false
+	found, err := set.Lookup("info@example.com")
+	if err != nil || len(found) != 1 || found[0].Destinations[0] != "secondary@example.org" {
+		t.Errorf("lookup with the primary down and Defer unset found %v, %v, want the secondary's alias", destinations(found), err)
+	}
+}
+
+func TestRefreshKeepsTableOverLimit(t *testing.T) {
+	defer func(entries int, bytes int64) { max_aliases, max_alias_bytes = entries, bytes }(max_aliases, max_alias_bytes)
+	max_aliases, max_alias_bytes = 2, 0
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := ioutil.WriteFile(path, []byte("info@example.com old@example.org\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	backend := &AliasBackend{Url: path}
+	set := &AliasSet{Backends: []*AliasBackend{backend}}
+	set.RefreshBackend(backend)
+	if backend.Err != nil || len(backend.Aliases) != 1 {
+		t.Fatalf("initial load gave %v, %v", backend.Aliases, backend.Err)
+	}
+
+	big := strings.Repeat("info@example.com new@example.org\n", 3)
+	if err := ioutil.WriteFile(path, []byte(big), 0640); err != nil {
+		t.Fatal(err)
+	}
+	set.RefreshBackend(backend)
+	if backend.Err == nil || !strings.Contains(backend.Err.Error(), "limit is 2") {
+		t.Errorf("table of 3 entries over a limit of 2: got %v", backend.Err)
+	}
+	if got := destinations(backend.Aliases); len(got) != 1 || got[0] != "old@example.org" {
+		t.Errorf("refresh over the entry limit left %v, want the previous table", got)
+	}
+
+	max_aliases, max_alias_bytes = 0, 40
+	set.RefreshBackend(backend)
+	if backend.Err == nil || !strings.Contains(backend.Err.Error(), "exceeds 40 bytes") {
+		t.Errorf("table of %d bytes over a limit of 40: got %v", len(big), backend.Err)
+	}
+	if got := destinations(backend.Aliases); len(got) != 1 || got[0] != "old@example.org" {
+		t.Errorf("refresh over the byte limit left %v, want the previous table", got)
+	}
+}
+
+func TestLookupStaleTable(t *testing.T) {
+	backend := testBackend("primary", Alias{Source: "info@example.com", Destinations: []string{"primary@example.org"}})
+	backend.Err = errors.New("connection refused")
+	set := &AliasSet{Strategy: "first", MaxStale: time.Hour, StaleDefer: true, Backends: []*AliasBackend{backend}}
+
+	backend.Fetched = time.Now().Add(-30 * time.Minute)
+	found, err := set.Lookup("info@example.com")
+	if err != nil || len(found) != 1 || found[0].Destinations[0] != "primary@example.org" {
+		t.Errorf("lookup within MaxStale found %v, %v, want the last good table served", destinations(found), err)
+	}
+
+	backend.Fetched = time.Now().Add(-2 * time.Hour)
+	_, err = set.Lookup("info@example.com")
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 451 || smtpErr.Message != "4.3.0 Alias table is stale" {
+		t.Errorf("lookup beyond MaxStale with StaleDefer: got %v, want a 451", err)
+	}
+
+	set.StaleDefer = false
+	found, err = set.Lookup("info@example.com")
+	if err != nil || len(found) != 1 {
+		t.Errorf("lookup beyond MaxStale without StaleDefer found %v, %v, want the stale table served", destinations(found), err)
+	}
+}
+
+func TestLookupPostmasterWithoutAlias(t *testing.T) {
+	empty := &AliasBackend{Url: "primary", Aliases: []Alias{}, Fetched: time.Now()}
+	set := &AliasSet{
+		Strategy:   "first",
+		Backends:   []*AliasBackend{empty},
+		Postmaster: "ops@example.org",
+		Domains:    []string{"example.com"},
+	}
+
+	for _, recipient := range []string{"postmaster@example.com", "PostMaster@Example.COM"} {
+		found, err := set.Lookup(recipient)
+		if err != nil || len(found) != 1 || found[0].Destinations[0] != "ops@example.org" {
+			t.Errorf("lookup of %s with an empty table found %v, %v, want it routed to the postmaster", recipient, destinations(found), err)
+		}
+	}
+
+	if found, err := set.Lookup("postmaster@elsewhere.example"); err == nil {
+		t.Errorf("postmaster of a foreign domain routed to %v", destinations(found))
+	}
+	if found, err := set.Lookup("abuse@example.com"); err == nil {
+		t.Errorf("unaliased abuse@ routed to %v", destinations(found))
+	}
+
+	// a postmaster in a local domain would loop back, so it isn't used
+	set.Postmaster = "root@example.com"
+	if found, err := set.Lookup("postmaster@example.com"); err == nil {
+		t.Errorf("postmaster routed to %v in a local domain", destinations(found))
+	}
+	set.Postmaster = "ops@example.org"
+
+	// an explicit alias wins over the default
+	empty.Aliases = []Alias{{Source: "postmaster@example.com", Destinations: []string{"admin@example.org"}}}
+	if found, err := set.Lookup("postmaster@example.com"); err != nil || found[0].Destinations[0] != "admin@example.org" {
+		t.Errorf("lookup of an aliased postmaster found %v, %v, want the alias", destinations(found), err)
+	}
+}
+
+// rawAliasServer answers every request with response, written verbatim, and
+// then closes the connection.
+func rawAliasServer(t *testing.T, response *string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				conn.Write([]byte(*response))
+			}
+			conn.Close()
+		}
+	}()
+	return "http://" + listener.Addr().String() + "/aliases"
+}
+
+func TestFetchTruncatedChunkedAliases(t *testing.T) {
+	defer func(sentinel string) { alias_sentinel = sentinel }(alias_sentinel)
+	alias_sentinel = ""
+
+	complete := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"21\r\ninfo@example.com old@example.org\n\r\n0\r\n\r\n"
+	response := complete
+	url := rawAliasServer(t, &response)
+
+	backend := &AliasBackend{Url: url}
+	set := &AliasSet{Backends: []*AliasBackend{backend}}
+	set.RefreshBackend(backend)
+	if backend.Err != nil || len(backend.Aliases) != 1 {
+		t.Fatalf("complete chunked table gave %v, %v", backend.Aliases, backend.Err)
+	}
+
+	// the connection drops after the first chunk, before the last one
+	response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"21\r\ninfo@example.com new@example.org\n\r\n"
+	set.RefreshBackend(backend)
+	if backend.Err == nil {
+		t.Error("truncated chunked response accepted")
+	}
+	if got := destinations(backend.Aliases); len(got) != 1 || got[0] != "old@example.org" {
+		t.Errorf("truncated fetch left %v, want the last good table", got)
+	}
+
+	// a body shorter than its Content-Length
+	response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 100\r\n\r\n" +
+		"info@example.com new@example.org\n"
+	if _, err := fetchEmailAliases(url); err == nil {
+		t.Error("body shorter than its Content-Length accepted")
+	}
+
+	// every chunk arrived, but the table stops before its sentinel
+	alias_sentinel = "# end"
+	response = complete
+	if _, err := fetchEmailAliases(url); err == nil || !strings.Contains(err.Error(), "missing sentinel") {
+		t.Errorf("table without its sentinel: got %v, want it rejected as truncated", err)
+	}
+	response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"21\r\ninfo@example.com new@example.org\n\r\n6\r\n# end\n\r\n0\r\n\r\n"
+	if aliases, err := fetchEmailAliases(url); err != nil || len(aliases) != 1 {
+		t.Errorf("table with its sentinel gave %v, %v", aliases, err)
+	}
+}
+
+func TestGetAliasMostSpecificCatchAll(t *testing.T) {
+	defer func(enabled bool) { suffix_match = enabled }(suffix_match)
+	suffix_match = true
+
+	// broader catch-alls listed first, so order can't decide
+	aliases := []Alias{
+		{Source: "@example.com", Destinations: []string{"company@example.org"}},
+		{Source: "@eng.example.com", Destinations: []string{"eng@example.org"}},
+		{Source: "@team.eng.example.com", Destinations: []string{"team@example.org"}},
+		{Source: "lead@team.eng.example.com", Destinations: []string{"lead@example.org"}},
+	}
+
+	for recipient, want := range map[string]string{
+		"lead@team.eng.example.com":    "lead@example.org",
+		"dev@team.eng.example.com":     "team@example.org",
+		"dev@infra.eng.example.com":    "eng@example.org",
+		"dev@a.b.team.eng.example.com": "team@example.org",
+		"sales@example.com":            "company@example.org",
+		"sales@emea.example.com":       "company@example.org",
+	} {
+		alias, err := getAlias(aliases, recipient)
+		if err != nil || alias.Destinations[0] != want {
+			t.Errorf("getAlias(%s) = %v, %v, want %s", recipient, alias.Destinations, err, want)
+		}
+	}
+
+	if alias, err := getAlias(aliases, "dev@example.net"); err == nil {
+		t.Errorf("recipient outside every catch-all matched %s", alias.Source)
+	}
+
+	suffix_match = false
+	if alias, err := getAlias(aliases, "dev@infra.eng.example.com"); err == nil {
+		t.Errorf("parent-domain catch-all %s matched without SuffixMatch", alias.Source)
+	}
+}
+
+func TestRefreshHoldsMassChange(t *testing.T) {
+	notified := make(chan map[string]interface{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&summary)
+		notified <- summary
+	}))
+	defer webhook.Close()
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	write := func(table string) {
+		if err := ioutil.WriteFile(path, []byte(table), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a@example.com ops@example.org\nb@example.com ops@example.org\nc@example.com ops@example.org\nd@example.com ops@example.org\n")
+	backend := &AliasBackend{Url: path}
+	set := &AliasSet{Backends: []*AliasBackend{backend}, MaxChange: 50, Webhook: webhook.URL}
+	set.RefreshBackend(backend)
+	held := counterValue(t, "relayd_alias_reloads_held_total", "source", metricsSource(path))
+
+	// one re-pointed entry of four is within the threshold
+	write("a@example.com new@example.org\nb@example.com ops@example.org\nc@example.com ops@example.org\nd@example.com ops@example.org\n")
+	set.RefreshBackend(backend)
+	if got := destinations(backend.Aliases); len(got) != 4 || got[0] != "new@example.org" || backend.Pending != nil {
+		t.Fatalf("reload changing 25%% gave %v, pending %v", got, backend.Pending)
+	}
+
+	// three of four: one removed, one added, one re-pointed
+	write("a@example.com ops@example.org\nb@example.com ops@example.org\nc@example.com ops@example.org\ne@example.com evil@example.net\n")
+	set.RefreshBackend(backend)
+	if got := destinations(backend.Aliases); len(got) != 4 || got[0] != "new@example.org" {
+		t.Errorf("reload changing 75%% installed %v, want the previous table kept", got)
+	}
+	if len(backend.Pending) != 4 {
+		t.Errorf("reload changing 75%% pending %v, want the new table held", backend.Pending)
+	}
+	if got := counterValue(t, "relayd_alias_reloads_held_total", "source", metricsSource(path)); got != held+1 {
+		t.Errorf("held reloads counted %v, want %v", got, held+1)
+	}
+	select {
+	case summary := <-notified:
+		if summary["Changes"] != float64(3) || summary["Entries"] != float64(4) {
+			t.Errorf("webhook told %v, want 3 changes of 4 entries", summary)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("webhook not notified of the held reload")
+	}
+
+	if accepted := set.AcceptPending(); accepted != 1 {
+		t.Errorf("AcceptPending accepted %d tables, want 1", accepted)
+	}
+	if got := destinations(backend.Aliases); len(got) != 4 || got[3] != "evil@example.net" || backend.Pending != nil {
+		t.Errorf("after the override the table is %v, pending %v", got, backend.Pending)
+	}
+}
+
+func TestExpiringAliases(t *testing.T) {
+	logged := captureLog(t)
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	yesterday := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	table := "conference@example.com events@example.org expires=" + tomorrow + "\n" +
+		"summit@example.com events@example.org expires=" + yesterday + "\n" +
+		"info@example.com ops@example.org\n" +
+		"promo@example.net sales@example.org expires=" + yesterday + "\n" +
+		"@example.net catchall@example.org\n"
+	if err := ioutil.WriteFile(path, []byte(table), 0640); err != nil {
+		t.Fatal(err)
+	}
+	backend := &AliasBackend{Url: path}
+	set := &AliasSet{Backends: []*AliasBackend{backend}}
+	set.RefreshBackend(backend)
+	if backend.Err != nil || len(backend.Aliases) != 5 {
+		t.Fatalf("table loaded %v, %v", backend.Aliases, backend.Err)
+	}
+
+	for recipient, want := range map[string]string{
+		"conference@example.com": "events@example.org", // not yet expired
+		"info@example.com":       "ops@example.org",    // never expires
+		"promo@example.net":      "catchall@example.org",
+	} {
+		if found, err := set.Lookup(recipient); err != nil || found[0].Destinations[0] != want {
+			t.Errorf("lookup of %s found %v, %v, want %s", recipient, destinations(found), err, want)
+		}
+	}
+
+	if found, err := set.Lookup("summit@example.com"); err != errAliasExpired {
+		t.Errorf("lookup of an expired alias found %v, %v, want it treated as missing", destinations(found), err)
+	}
+	if !strings.Contains(logged.String(), "alias summit@example.com expired at") {
+		t.Errorf("log %q lacks the expired alias hit", logged.String())
+	}
+
+	if expires := parseExpiry("next week"); !expires.IsZero() {
+		t.Errorf("invalid expiry parsed as %v", expires)
+	}
+}
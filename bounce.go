@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// failureStatus returns the SMTP reply and RFC 3463 status code for a
+// failed delivery.
+func failureStatus(err error) (string, string) {
+	code, msg := 0, err.Error()
+	switch e := err.(type) {
+	case *textproto.Error:
+		code, msg = e.Code, e.Msg
+	case smtpd.Error:
+		code, msg = e.Code, e.Message
+	}
+
+	status := enhancedStatus.FindString(msg)
+	if status == "" {
+		status = "5.0.0"
+	}
+	if code == 0 {
+		return msg, status
+	}
+	return strconv.Itoa(code) + " " + msg, status
+}
+
+// bounceFailure is one destination a DSN reports, and why it failed.
+type bounceFailure struct {
+	recipient   string
+	destination string
+	err         error
+}
+
+// buildBounce constructs an RFC 3464 delivery status notification telling
+// returnPath that original could not be delivered to the failures'
+// destinations, and that omitted more were left out of the report.
+func buildBounce(host string, returnPath string, failures []bounceFailure, omitted int, original []byte, now time.Time) []byte {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	text, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}})
+	text.Write([]byte("This is the mail system at " + host + ".\r\n\r\n" +
+		"Your message could not be delivered to one or more recipients.\r\n" +
+		"It has not been delivered and will not be retried.\r\n\r\n"))
+	for _, f := range failures {
+		reply, _ := failureStatus(f.err)
+		text.Write([]byte("<" + f.destination + ">: " + reply + "\r\n"))
+	}
+	if omitted > 0 {
+		text.Write([]byte("\r\n" + strconv.Itoa(omitted) + " more failed deliveries are not listed.\r\n"))
+	}
+
+	report, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	report.Write([]byte("Reporting-MTA: dns; " + host + "\r\n" +
+		"Arrival-Date: " + now.Format(time.RFC1123Z) + "\r\n"))
+	for _, f := range failures {
+		reply, status := failureStatus(f.err)
+		report.Write([]byte("\r\n"))
+		if f.recipient != "" && !strings.EqualFold(f.recipient, f.destination) {
+			report.Write([]byte("Original-Recipient: rfc822; " + f.recipient + "\r\n"))
+		}
+		report.Write([]byte("Final-Recipient: rfc822; " + f.destination + "\r\n" +
+			"Action: failed\r\n" +
+			"Status: " + status + "\r\n"))
+		if _, ok := f.err.(*textproto.Error); ok {
+			report.Write([]byte("Diagnostic-Code: smtp; " + reply + "\r\n"))
+		}
+	}
+
+	headers, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	headers.Write(original[:headerSize(original)])
+	headers.Write([]byte("\r\n"))
+	parts.Close()
+
+	message := "From: Mail Delivery System <MAILER-DAEMON@" + host + ">\r\n" +
+		"To: <" + returnPath + ">\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + strconv.FormatInt(now.UnixNano(), 36) + "@" + host + ">\r\n" +
+		"Auto-Submitted: auto-replied\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + parts.Boundary() + "\"\r\n" +
+		"\r\n"
+	return append([]byte(message), body.Bytes()...)
+}
+
+// bounceLimiter caps the bounces one return path gets in a window at max, so
+// an outage doesn't flood a sender. Failures past the cap are held, without
+// repeats, and go out together in one DSN once the window has ended, listing
+// at most maxListedFailures of them. Each return path's window is kept in a
+// file in the spool's bounces folder, so held failures survive a restart.
+type bounceLimiter struct {
+	sync.Mutex
+	queue  *Queue
+	dir    string
+	window time.Duration
+	max    int
+}
+
+// bounceWindow is the state of one return path's window.
+type bounceWindow struct {
+	ReturnPath string
+	Ends       time.Time
+	Sent       int
+	Held       []heldFailure
+	Omitted    int
+	Original   []byte
+}
+
+// heldFailure is a bounceFailure as kept on disk.
+type heldFailure struct {
+	Recipient   string
+	Destination string
+	Code        int
+	Message     string
+}
+
+const maxListedFailures = 100
+
+func newBounceLimiter(q *Queue, window time.Duration, max int) (*bounceLimiter, error) {
+	l := &bounceLimiter{queue: q, dir: filepath.Join(q.dir, "bounces"), window: window, max: max}
+	if err := os.MkdirAll(l.dir, 0750); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func holdFailure(f bounceFailure) heldFailure {
+	h := heldFailure{Recipient: f.recipient, Destination: f.destination, Message: f.err.Error()}
+	switch e := f.err.(type) {
+	case *textproto.Error:
+		h.Code, h.Message = e.Code, e.Msg
+	case smtpd.Error:
+		h.Code, h.Message = e.Code, e.Message
+	}
+	return h
+}
+
+func (h heldFailure) failure() bounceFailure {
+	err := errors.New(h.Message)
+	if h.Code > 0 {
+		err = &textproto.Error{Code: h.Code, Msg: h.Message}
+	}
+	return bounceFailure{h.Recipient, h.Destination, err}
+}
+
+func (l *bounceLimiter) path(returnPath string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(returnPath)))
+	return filepath.Join(l.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readWindow returns the window kept at path, or nil if there is none.
+func readWindow(path string) (*bounceWindow, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	w := &bounceWindow{}
+	if err = json.Unmarshal(data, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Allow reports whether a bounce of failure may go to returnPath now, and
+// holds it for the window's aggregate DSN otherwise. A nil limiter allows
+// every bounce, and so does one that can't record the window.
+func (l *bounceLimiter) Allow(returnPath string, failure bounceFailure, original []byte) bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	path := l.path(returnPath)
+	w, err := readWindow(path)
+	if err != nil {
+		log.Println("discarding unreadable bounce window "+path, err)
+	}
+	now := time.Now()
+	if w != nil && !now.Before(w.Ends) {
+		l.send(w)
+		w = nil
+	}
+	if w == nil {
+		w = &bounceWindow{ReturnPath: returnPath, Ends: now.Add(l.window)}
+	}
+
+	allowed := w.Sent < l.max
+	if allowed {
+		w.Sent++
+	} else {
+		held := holdFailure(failure)
+		repeat := false
+		for _, h := range w.Held {
+			if strings.EqualFold(h.Destination, held.Destination) && h.Message == held.Message {
+				repeat = true
+			}
+		}
+		if repeat {
+			return false
+		}
+		if len(w.Held) < maxListedFailures {
+			w.Held = append(w.Held, held)
+		} else {
+			w.Omitted++
+		}
+		if w.Original == nil {
+			w.Original = original
+		}
+	}
+
+	if err = writeJSON(path, w); err != nil {
+		log.Println("ALERT: failed to record bounce window for "+returnPath, err)
+		return true
+	}
+	return allowed
+}
+
+// Flush sends one DSN for the failures held in each window that has ended.
+func (l *bounceLimiter) Flush() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*.json"))
+	if err != nil {
+		log.Println("failed to scan bounce windows", err)
+		return
+	}
+	now := time.Now()
+	for _, path := range paths {
+		w, err := readWindow(path)
+		if err != nil {
+			log.Println("discarding unreadable bounce window "+path, err)
+			os.Remove(path)
+			continue
+		}
+		if w == nil || now.Before(w.Ends) {
+			continue
+		}
+		l.send(w)
+		os.Remove(path)
+	}
+}
+
+func (l *bounceLimiter) send(w *bounceWindow) {
+	if len(w.Held) == 0 {
+		return
+	}
+	failures := make([]bounceFailure, len(w.Held))
+	for i, h := range w.Held {
+		failures[i] = h.failure()
+	}
+	log.Printf("sending %d held bounces to %s in one notification", len(w.Held)+w.Omitted, w.ReturnPath)
+	deliverBounce(l.queue, w.ReturnPath, failures, w.Omitted, w.Original)
+}
+
+// sendBounce notifies returnPath of a permanent delivery failure. It never
+// bounces a bounce. The notification goes out with the null sender through
+// the queue when there is one, else directly.
+func sendBounce(q *Queue, returnPath string, recipient string, destination string, original []byte, failure error) {
+	if returnPath == "" || temporaryError(failure) {
+		return
+	}
+
+	ix := strings.LastIndex(returnPath, "@")
+	if ix < 0 {
+		return
+	}
+
+	failed := bounceFailure{recipient, destination, failure}
+	if q != nil && !q.bounces.Allow(returnPath, failed, original) {
+		log.Println("holding bounce of failed delivery to " + destination + " for " + returnPath + ", over MaxBounces")
+		return
+	}
+
+	log.Println("bouncing failed delivery to " + destination + " back to " + returnPath)
+	deliverBounce(q, returnPath, []bounceFailure{failed}, 0, original)
+}
+
+// deliverBounce sends returnPath a DSN for failures through the queue when
+// there is one, else directly.
+func deliverBounce(q *Queue, returnPath string, failures []bounceFailure, omitted int, original []byte) {
+	ix := strings.LastIndex(returnPath, "@")
+	dsn := buildBounce(*hostname, returnPath, failures, omitted, original, time.Now())
+	item := &QueueItem{
+		Recipients: []string{returnPath},
+		Data:       dsn,
+		Domain:     returnPath[ix+1:],
+		Route:      smart_host,
+		Size:       len(dsn),
+	}
+
+	if q != nil {
+		if err := q.Enqueue(item); err != nil {
+			log.Println("ALERT: failed to queue bounce to "+returnPath, err)
+		}
+		return
+	}
+
+	go func() {
+		mailhosts := []string{smart_host}
+		var err error
+		if smart_host == "" {
+			var hosts []string
+			hosts, err = getMX(item.Domain)
+			mailhosts = nil
+			for _, host := range hosts {
+				mailhosts = append(mailhosts, host+":smtp")
+			}
+		}
+		if err == nil && len(mailhosts) == 0 {
+			err = errors.New("no mx found for " + item.Domain)
+		}
+		if err == nil {
+			err = deliverMX("", returnPath, dsn, mailhosts, nil)
+		}
+		if err != nil {
+			log.Println("failed to deliver bounce to "+returnPath, err)
+		}
+	}()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBounceLimiterAggregates(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.bounces, err = newBounceLimiter(q, 200*time.Millisecond, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	original := []byte("Subject: hi\r\n\r\nhi\r\n")
+	failure := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	for i := 0; i < 10; i++ {
+		sendBounce(q, "Sender@example.com", "", "user"+strconv.Itoa(i)+"@example.org", original, failure)
+	}
+	// a repeat of a held failure isn't listed twice
+	sendBounce(q, "sender@example.com", "", "user9@example.org", original, failure)
+	sendBounce(q, "other@example.com", "", "user0@example.org", original, failure)
+
+	if bounces := spooled(t, q.dir); len(bounces) != 3 {
+		t.Fatalf("spooled %d bounces inside the window, want MaxBounces for sender and one for other", len(bounces))
+	}
+
+	// relayd restarts inside the window; the held failures go out once
+	// it has ended
+	if q, err = openQueue(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if q.bounces, err = newBounceLimiter(q, time.Hour, 2); err != nil {
+		t.Fatal(err)
+	}
+	q.scan(nil)
+	if bounces := spooled(t, q.dir); len(bounces) != 3 {
+		t.Fatalf("spooled %d bounces before the window ended, want 3", len(bounces))
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	q.scan(nil)
+	var aggregate []QueueItem
+	for _, bounce := range spooled(t, q.dir) {
+		if strings.Count(string(bounce.Data), "Final-Recipient:") > 1 {
+			aggregate = append(aggregate, bounce)
+		}
+	}
+	if len(aggregate) != 1 {
+		t.Fatalf("spooled %d aggregate bounces after the window, want one", len(aggregate))
+	}
+	dsn := string(aggregate[0].Data)
+	if aggregate[0].Recipients[0] != "Sender@example.com" {
+		t.Errorf("aggregate bounce goes to %v", aggregate[0].Recipients)
+	}
+	if n := strings.Count(dsn, "Final-Recipient:"); n != 8 {
+		t.Errorf("aggregate bounce lists %d failures, want the 8 held", n)
+	}
+	for i := 2; i < 10; i++ {
+		if !strings.Contains(dsn, "Final-Recipient: rfc822; user"+strconv.Itoa(i)+"@example.org") {
+			t.Errorf("aggregate bounce misses user%d", i)
+		}
+	}
+	if !strings.Contains(dsn, "Diagnostic-Code: smtp; 550 5.1.1 No such user") {
+		t.Error("aggregate bounce lost the upstream's reply")
+	}
+	if windows, _ := filepath.Glob(filepath.Join(q.bounces.dir, "*.json")); len(windows) != 0 {
+		t.Errorf("ended windows still kept: %v", windows)
+	}
+}
+
+func TestBounceLimiterCapsListing(t *testing.T) {
+	q, err := openQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newBounceLimiter(q, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	for i := 0; i < maxListedFailures+6; i++ {
+		l.Allow("sender@example.com", bounceFailure{destination: "user" + strconv.Itoa(i) + "@example.org", err: failure}, nil)
+	}
+
+	w, err := readWindow(l.path("sender@example.com"))
+	if err != nil || w == nil {
+		t.Fatalf("window not kept: %v", err)
+	}
+	if len(w.Held) != maxListedFailures || w.Omitted != 5 {
+		t.Errorf("held %d and omitted %d, want %d and 5", len(w.Held), w.Omitted, maxListedFailures)
+	}
+	var failures []bounceFailure
+	for _, h := range w.Held {
+		failures = append(failures, h.failure())
+	}
+	dsn := string(buildBounce("mx.example.com", "sender@example.com", failures, w.Omitted, []byte("Subject: hi\r\n\r\n"), time.Now()))
+	if !strings.Contains(dsn, "5 more failed deliveries are not listed") {
+		t.Error("bounce doesn't mention the omitted failures")
+	}
+}
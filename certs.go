@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type CertSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// fileCertSource serves a certificate pair from disk. It checks the files'
+// mtimes at most every certCheckInterval during handshakes and loads them
+// again when they change, so renewed certificates are picked up without a
+// restart. A pair that fails to load, say while a renewal is half written,
+// leaves the current certificate in place until the next check.
+type fileCertSource struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+var certCheckInterval = 30 * time.Second
+
+func newFileCertSource(certFile string, keyFile string) (*fileCertSource, error) {
+	source := &fileCertSource{}
+	if err := source.Reload(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func certModTime(certFile string, keyFile string) time.Time {
+	var modified time.Time
+	for _, path := range []string{certFile, keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// Reload loads the pair from certFile and keyFile for subsequent handshakes,
+// keeping the current certificate if it doesn't load.
+func (source *fileCertSource) Reload(certFile string, keyFile string) error {
+	source.Lock()
+	defer source.Unlock()
+	return source.load(certFile, keyFile)
+}
+
+func (source *fileCertSource) load(certFile string, keyFile string) error {
+	log.Println("loading certificate", certFile, keyFile)
+	modified := certModTime(certFile, keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	source.certFile, source.keyFile = certFile, keyFile
+	source.cert = &cert
+	source.modified = modified
+	source.checked = time.Now()
+	return nil
+}
+
+func (source *fileCertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	source.Lock()
+	defer source.Unlock()
+
+	if time.Since(source.checked) >= certCheckInterval {
+		source.checked = time.Now()
+		if certModTime(source.certFile, source.keyFile).After(source.modified) {
+			if err := source.load(source.certFile, source.keyFile); err != nil {
+				log.Println("keeping current certificate:", err)
+			}
+		}
+	}
+	return source.cert, nil
+}
+
+// acmeCertSource obtains and renews certificates through autocert. The
+// HTTP-01 challenge is answered on httpBind since SMTP ports cannot serve
+// it.
+type acmeCertSource struct {
+	manager *autocert.Manager
+	domains []string
+}
+
+func newAcmeCertSource(domains []string, email string, cacheDir string, httpBind string) (*acmeCertSource, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("need ACMEDomains for acme certificates")
+	}
+	if cacheDir == "" {
+		cacheDir = "/var/lib/relayd/acme"
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Email:      email,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+	}
+
+	if httpBind == "" {
+		httpBind = ":80"
+	}
+	go func() {
+		log.Println("acme challenge listener on " + httpBind)
+		log.Fatal(http.ListenAndServe(httpBind, manager.HTTPHandler(nil)))
+	}()
+
+	return &acmeCertSource{manager, domains}, nil
+}
+
+// GetCertificate fills in the first configured domain for clients that do
+// not send SNI, which many SMTP clients don't.
+func (source *acmeCertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		named := *hello
+		named.ServerName = source.domains[0]
+		hello = &named
+	}
+	return source.manager.GetCertificate(hello)
+}
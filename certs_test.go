@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writePair writes cert and its key as PEM files in dir.
+func writePair(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// served returns the certificate source presents to a client asking for
+// serverName.
+func served(t *testing.T, source CertSource, serverName string) *x509.Certificate {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		tls.Server(serverConn, &tls.Config{GetCertificate: source.GetCertificate}).Handshake()
+		serverConn.Close()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState().PeerCertificates[0]
+}
+
+func TestFileCertSourceReload(t *testing.T) {
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	first := testCertificate(t, "mail.example.com")
+	certFile, keyFile := writePair(t, dir, first)
+	source, err := newFileCertSource(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(t, source, "mail.example.com"); !bytes.Equal(got.Raw, first.Leaf.Raw) {
+		t.Fatalf("served %s, want the certificate on disk", got.Subject)
+	}
+
+	renewed := testCertificate(t, "mail.example.com")
+	writePair(t, dir, renewed)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if got := served(t, source, "mail.example.com"); !bytes.Equal(got.Raw, renewed.Leaf.Raw) {
+		t.Errorf("served %v after renewal, want the renewed certificate", got.NotBefore)
+	}
+
+	// a half-written renewal keeps the current certificate
+	ioutil.WriteFile(keyFile, []byte("truncated"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if got := served(t, source, "mail.example.com"); !bytes.Equal(got.Raw, renewed.Leaf.Raw) {
+		t.Error("unloadable pair replaced the current certificate")
+	}
+}
+
+// memoryCache is an autocert.Cache standing in for an ACME account whose
+// certificates were already issued.
+type memoryCache struct {
+	sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if data, ok := c.entries[key]; ok {
+		return data, nil
+	}
+	return nil, autocert.ErrCacheMiss
+}
+
+func (c *memoryCache) Put(ctx context.Context, key string, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = data
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+func TestAcmeCertSource(t *testing.T) {
+	// autocert issues ECDSA certificates to clients that support them
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	cache := &memoryCache{entries: map[string][]byte{"mail.example.com": data}}
+
+	source := &acmeCertSource{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       cache,
+			HostPolicy:  autocert.HostWhitelist("mail.example.com"),
+			RenewBefore: time.Hour,
+		},
+		domains: []string{"mail.example.com"},
+	}
+
+	for _, serverName := range []string{"mail.example.com", ""} {
+		if got := served(t, source, serverName); !bytes.Equal(got.Raw, der) {
+			t.Errorf("served %s for SNI %q, want the issued certificate", got.Subject, serverName)
+		}
+	}
+
+	// hostnames outside ACMEDomains are refused before any ACME request
+	if _, err := source.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("certificate obtained for a hostname outside ACMEDomains")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var source_port_min = 0
+var source_port_max = 0
+
+// dial_timeout bounds connecting to an upstream, command_timeout each SMTP
+// command after that, so a stuck MX fails over to the retry path.
+var dial_timeout = 30 * time.Second
+var command_timeout = 5 * time.Minute
+
+func parsePortRange(spec string) (int, int, error) {
+	bounds := strings.SplitN(spec, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, errors.New("invalid port range " + spec)
+	}
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return 0, 0, errors.New("invalid port range " + spec)
+		}
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.New("invalid port range " + spec)
+	}
+	return min, max, nil
+}
+
+// dialOutbound connects to mailhost, binding the local end to a port in the
+// configured source range when one is set. Ports already in use are skipped,
+// starting from a random offset so concurrent deliveries spread out.
+func dialOutbound(mailhost string) (net.Conn, error) {
+	if source_port_min == 0 {
+		return net.DialTimeout("tcp", mailhost, dial_timeout)
+	}
+
+	count := source_port_max - source_port_min + 1
+	offset := rand.Intn(count)
+
+	for i := 0; i < count; i++ {
+		port := source_port_min + (offset+i)%count
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{Port: port}, Timeout: dial_timeout}
+
+		conn, err := dialer.Dial("tcp", mailhost)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("no free source port for " + mailhost)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestDialOutboundSourcePort(t *testing.T) {
+	defer func(min int, max int) { source_port_min, source_port_max = min, max }(source_port_min, source_port_max)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// the first port of the range is taken, the second free
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+	free, err := net.Listen("tcp", ":"+strconv.Itoa(port+1))
+	if err != nil {
+		t.Skipf("port %d is not free: %v", port+1, err)
+	}
+	free.Close()
+
+	source_port_min, source_port_max = port, port+1
+	conn, err := dialOutbound(upstream.Addr().String())
+	if err != nil {
+		t.Fatalf("dial with source ports %d-%d: %v", port, port+1, err)
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().(*net.TCPAddr).Port; local != port+1 {
+		t.Errorf("outbound connection from port %d, want %d, the free port of the range", local, port+1)
+	}
+
+	// with that connection still open every port of the range is in use
+	if extra, err := dialOutbound(upstream.Addr().String()); err == nil {
+		extra.Close()
+		t.Errorf("dial with every port of %d-%d in use succeeded", port, port+1)
+	}
+}
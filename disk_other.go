@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+)
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space checks are not supported on this platform")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/emersion/go-msgauth/dkim"
+	"io/ioutil"
+	"strings"
+)
+
+type DkimKey struct {
+	Domain   string
+	Selector string
+	KeyFile  string
+	Tenant   string
+
+	signer   crypto.Signer
+	fallback bool
+}
+
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+func loadSigner(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem data in " + path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type in " + path)
+	}
+	return signer, nil
+}
+
+func loadDkimKeys(keys []DkimKey) error {
+	for i := range keys {
+		signer, err := loadSigner(keys[i].KeyFile)
+		if err != nil {
+			return err
+		}
+		keys[i].signer = signer
+	}
+	return nil
+}
+
+// selectDkimKey picks the key for the alias tenant, then for the From domain,
+// then the DKIMKeyFile key. It returns nil when no key matches and the
+// message goes out unsigned.
+func selectDkimKey(keys []DkimKey, alias Alias, fromDomain string) *DkimKey {
+	if alias.Tenant != "" {
+		for i := range keys {
+			if keys[i].Tenant == alias.Tenant {
+				return &keys[i]
+			}
+		}
+	}
+
+	for i := range keys {
+		if fromDomain != "" && strings.EqualFold(keys[i].Domain, fromDomain) {
+			return &keys[i]
+		}
+	}
+
+	for i := range keys {
+		if keys[i].fallback {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
+
+func (key *DkimKey) Sign(data []byte) ([]byte, error) {
+	options := &dkim.SignOptions{
+		Domain:                 key.Domain,
+		Selector:               key.Selector,
+		Signer:                 key.signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaders,
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(data), options); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDkimKey(t *testing.T, domain string, tenant string) DkimKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), domain+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return DkimKey{Domain: domain, Selector: "relay", KeyFile: path, Tenant: tenant}
+}
+
+func TestDkimKeyPerTenant(t *testing.T) {
+	keys := []DkimKey{testDkimKey(t, "alpha.example", "alpha"), testDkimKey(t, "beta.example", "beta")}
+	if err := loadDkimKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("From: someone@elsewhere.example\r\nSubject: hi\r\n\r\nhi\r\n")
+
+	for _, test := range []struct {
+		alias  Alias
+		from   string
+		domain string
+	}{
+		{Alias{Source: "info@alpha.example", Tenant: "alpha"}, "elsewhere.example", "alpha.example"},
+		{Alias{Source: "info@beta.example", Tenant: "beta"}, "elsewhere.example", "beta.example"},
+		{Alias{Source: "info@beta.example", Tenant: "beta"}, "alpha.example", "beta.example"},
+		{Alias{Source: "info@other.example"}, "alpha.example", "alpha.example"},
+	} {
+		key := selectDkimKey(keys, test.alias, test.from)
+		if key == nil || key.Domain != test.domain {
+			t.Errorf("tenant %q from %s picked %v, want the %s key", test.alias.Tenant, test.from, key, test.domain)
+			continue
+		}
+		signed, err := key.Sign(message)
+		if err != nil {
+			t.Fatalf("signing for %s: %v", test.domain, err)
+		}
+		header, err := messageHeader(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := header.Get("DKIM-Signature")
+		if !strings.Contains(signature, "d="+test.domain+";") || !strings.Contains(signature, "s=relay;") {
+			t.Errorf("message for tenant %q signed with %q, want d=%s", test.alias.Tenant, signature, test.domain)
+		}
+	}
+
+	if key := selectDkimKey(keys, Alias{Tenant: "gamma"}, "elsewhere.example"); key != nil {
+		t.Errorf("unmatched tenant and From domain picked the %s key, want the message unsigned", key.Domain)
+	}
+}
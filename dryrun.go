@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// dryRun loads every alias source, resolves the MX of each destination
+// domain and prints to w what would happen to each alias, without listening
+// or delivering. It returns the exit status: zero when nothing needs fixing.
+func dryRun(w io.Writer, sources []string, concurrency int) int {
+	type entry struct {
+		source string
+		alias  Alias
+	}
+	var entries []entry
+	status := 0
+
+	for _, source := range sources {
+		aliases, err := fetchEmailAliases(source)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", source, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d aliases\n", source, len(aliases))
+		for _, alias := range aliases {
+			entries = append(entries, entry{source, alias})
+		}
+	}
+
+	seen := make(map[string]bool)
+	var domains []string
+	for _, e := range entries {
+		for _, destination := range e.alias.Destinations {
+			domain := strings.ToLower(destination[strings.LastIndex(destination, "@")+1:])
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	sort.Strings(domains)
+	mx := resolveMX(domains, concurrency)
+
+	valid, unresolvable, duplicates, self := 0, 0, 0, 0
+	first := make(map[string]string)
+	for _, e := range entries {
+		key := normalizeAddress(e.alias.Source)
+		if where, ok := first[key]; ok {
+			fmt.Fprintf(w, "  duplicate     %s at %s:%d, first defined at %s\n", e.alias.Source, e.source, e.alias.Line, where)
+			duplicates++
+		} else {
+			first[key] = fmt.Sprintf("%s:%d", e.source, e.alias.Line)
+		}
+
+		ok := true
+		for _, destination := range e.alias.Destinations {
+			if normalizeAddress(destination) == key {
+				fmt.Fprintf(w, "  self          %s -> %s at %s:%d\n", e.alias.Source, destination, e.source, e.alias.Line)
+				self++
+				ok = false
+				continue
+			}
+
+			domain := strings.ToLower(destination[strings.LastIndex(destination, "@")+1:])
+			if result := mx[domain]; result.Err != nil || len(result.Hosts) == 0 {
+				reason := "no mx found"
+				if result.Err != nil {
+					reason = result.Err.Error()
+				}
+				fmt.Fprintf(w, "  unresolvable  %s -> %s (%s)\n", e.alias.Source, destination, reason)
+				unresolvable++
+				ok = false
+				continue
+			}
+			fmt.Fprintf(w, "  ok            %s -> %s via %s\n", e.alias.Source, destination, strings.Join(mx[domain].Hosts, ", "))
+		}
+		if ok {
+			valid++
+		}
+	}
+
+	fmt.Fprintf(w, "%d valid aliases, %d unresolvable destinations, %d duplicates, %d self-references\n", valid, unresolvable, duplicates, self)
+	if unresolvable > 0 || duplicates > 0 || self > 0 {
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	fakeDNS(t, "dryrun.example. 300 IN MX 10 mx.dryrun.example.")
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	table := "info@example.com user@dryrun.example\n" +
+		"sales@example.com user@nomx.dryrun.example\n" +
+		"info@example.com other@dryrun.example\n" +
+		"loop@example.com loop@example.com\n"
+	if err := ioutil.WriteFile(path, []byte(table), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if status := dryRun(&out, []string{path}, 2); status != 1 {
+		t.Errorf("dryRun returned %d for a table with problems, want 1", status)
+	}
+	for _, want := range []string{
+		path + ": 4 aliases",
+		"ok            info@example.com -> user@dryrun.example via mx.dryrun.example",
+		"unresolvable  sales@example.com -> user@nomx.dryrun.example",
+		"duplicate     info@example.com at " + path + ":3, first defined at " + path + ":1",
+		"self          loop@example.com -> loop@example.com",
+		"2 valid aliases, 1 unresolvable destinations, 1 duplicates, 1 self-references",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dry run output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	clean := filepath.Join(t.TempDir(), "aliases")
+	if err := ioutil.WriteFile(clean, []byte("info@example.com user@dryrun.example\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if status := dryRun(&out, []string{clean}, 2); status != 0 {
+		t.Errorf("dryRun returned %d for a clean table, want 0", status)
+	}
+}
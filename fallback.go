@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fallbackRouter reroutes a destination domain through a smarthost after
+// a run of consecutive direct delivery failures. While rerouted, one
+// delivery per probe interval goes direct again, and a success there
+// resumes direct delivery.
+type fallbackRouter struct {
+	sync.Mutex
+	host     string
+	after    int
+	probe    time.Duration
+	failures map[string]int
+	rerouted map[string]time.Time
+}
+
+func newFallbackRouter(host string, after int, probe time.Duration) *fallbackRouter {
+	return &fallbackRouter{
+		host:     host,
+		after:    after,
+		probe:    probe,
+		failures: make(map[string]int),
+		rerouted: make(map[string]time.Time),
+	}
+}
+
+// Route returns the smarthost when domain is rerouted and isn't due for a
+// direct probe.
+func (f *fallbackRouter) Route(domain string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	next, ok := f.rerouted[domain]
+	if !ok {
+		return "", false
+	}
+	if time.Now().Before(next) {
+		return f.host, true
+	}
+
+	f.rerouted[domain] = time.Now().Add(f.probe)
+	log.Println("probing direct delivery to " + domain)
+	return "", false
+}
+
+// Observe records the outcome of a direct delivery to domain.
+func (f *fallbackRouter) Observe(domain string, err error) {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if err == nil {
+		if _, ok := f.rerouted[domain]; ok {
+			log.Println("resuming direct delivery to " + domain)
+		}
+		delete(f.failures, domain)
+		delete(f.rerouted, domain)
+		return
+	}
+
+	if !fallbackFailure(err) {
+		return
+	}
+
+	f.failures[domain]++
+	if _, ok := f.rerouted[domain]; ok {
+		f.rerouted[domain] = time.Now().Add(f.probe)
+		return
+	}
+	if f.failures[domain] >= f.after {
+		f.rerouted[domain] = time.Now().Add(f.probe)
+		log.Printf("ALERT: %d consecutive direct delivery failures to %s, routing via %s", f.failures[domain], domain, f.host)
+	}
+}
+
+// fallbackFailure reports whether err suggests the destination won't take
+// mail from us directly: a temporary failure or a 5.7.x policy rejection,
+// rather than a problem with a single recipient.
+func fallbackFailure(err error) bool {
+	if tpErr, ok := err.(*textproto.Error); ok && strings.HasPrefix(tpErr.Msg, "5.7.") {
+		return true
+	}
+	return temporaryError(err)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestFallbackAfterDirectFailures(t *testing.T) {
+	fallback := newFallbackRouter("smarthost.example.net:587", 3, 200*time.Millisecond)
+	refused := &connectError{errors.New("connection refused")}
+
+	for i := 0; i < 2; i++ {
+		fallback.Observe("example.org", refused)
+	}
+	if host, ok := fallback.Route("example.org"); ok {
+		t.Fatalf("rerouted to %s after 2 failures, want direct until 3", host)
+	}
+
+	// unknown users say nothing about the destination taking our mail
+	fallback.Observe("example.org", &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	if _, ok := fallback.Route("example.org"); ok {
+		t.Fatal("rerouted after a rejected recipient")
+	}
+
+	fallback.Observe("example.org", &textproto.Error{Code: 554, Msg: "5.7.1 Service unavailable, client host blocked"})
+	if host, ok := fallback.Route("example.org"); !ok || host != "smarthost.example.net:587" {
+		t.Fatalf("after 3 failures routed to %q, %v, want the smarthost", host, ok)
+	}
+	if _, ok := fallback.Route("example.net"); ok {
+		t.Error("other destinations rerouted too")
+	}
+
+	// once the probe interval passes one delivery goes direct again
+	time.Sleep(250 * time.Millisecond)
+	if host, ok := fallback.Route("example.org"); ok {
+		t.Fatalf("no direct probe after the interval, routed to %s", host)
+	}
+	if _, ok := fallback.Route("example.org"); !ok {
+		t.Error("more than one delivery probing direct in an interval")
+	}
+	fallback.Observe("example.org", nil)
+	if host, ok := fallback.Route("example.org"); ok {
+		t.Errorf("still routed to %s after a direct probe succeeded", host)
+	}
+
+	var unset *fallbackRouter
+	if _, ok := unset.Route("example.org"); ok {
+		t.Error("rerouted without a fallback host")
+	}
+}
@@ -0,0 +1,27 @@
+module github.com/andelo/relayd
+
+go 1.25.0
+
+// bitbucket.org/chrj/smtpd is imported but not required here: no version of
+// it could be fetched when this file was written, so run
+// "go get bitbucket.org/chrj/smtpd" with network access to pin it and add
+// its go.sum entries.
+
+require (
+	github.com/emersion/go-msgauth v0.6.8
+	github.com/miekg/dns v1.1.73
+	github.com/prometheus/client_golang v1.19.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.57.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func messageHeader(data []byte) (mail.Header, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// isGroup reports whether an address header uses RFC 5322 group syntax such
+// as "undisclosed-recipients:;", looking for a colon outside quoted strings,
+// comments and angle brackets.
+func isGroup(value string) bool {
+	quoted, escaped := false, false
+	comment, angle := 0, 0
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case quoted:
+			quoted = c != '"'
+		case c == '"':
+			quoted = true
+		case c == '(':
+			comment++
+		case c == ')' && comment > 0:
+			comment--
+		case comment > 0:
+		case c == '<':
+			angle++
+		case c == '>' && angle > 0:
+			angle--
+		case c == ':' && angle == 0:
+			return true
+		}
+	}
+	return false
+}
+
+// headerDomain returns the lowercased domain of the first address in the
+// given header field, or "" when it is missing, unparseable or a group,
+// whose members can't be attributed as the author.
+func headerDomain(header mail.Header, key string) string {
+	if isGroup(header.Get(key)) {
+		return ""
+	}
+	list, err := header.AddressList(key)
+	if err != nil || len(list) == 0 {
+		return ""
+	}
+	ix := strings.LastIndex(list[0].Address, "@")
+	return strings.ToLower(list[0].Address[ix+1:])
+}
+
+// canonicalLines rewrites bare LF line endings as CRLF and terminates the
+// last line. smtpd has already removed dot-stuffing and net/smtp's data
+// writer re-applies it, so the handler only ever sees unstuffed data; this
+// keeps the header lines added here from mixing with LF-only bodies and makes
+// the DKIM body hash cover exactly the lines that go on the wire.
+func canonicalLines(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data) + 2)
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\r\n")) {
+		if bytes.HasSuffix(out.Bytes(), []byte("\r")) {
+			out.WriteByte('\n')
+		} else {
+			out.WriteString("\r\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// headerSize returns the length of the header section of data, which is all
+// of data when no blank line ends it.
+func headerSize(data []byte) int {
+	size := len(data)
+	if ix := bytes.Index(data, []byte("\r\n\r\n")); ix >= 0 {
+		size = ix
+	}
+	if ix := bytes.Index(data, []byte("\n\n")); ix >= 0 && ix < size {
+		size = ix
+	}
+	return size
+}
+
+// checkHeaderSize rejects a message whose header section is over max bytes.
+// A max of zero disables the check.
+func checkHeaderSize(data []byte, max int) error {
+	if max > 0 && headerSize(data) > max {
+		return smtpd.Error{Code: 552, Message: "5.3.4 Message header size exceeds limit"}
+	}
+	return nil
+}
+
+// countReceived counts the Received fields in the header section of data. It
+// scans lines rather than parsing, so a malformed header can't hide a loop.
+func countReceived(data []byte) int {
+	count := 0
+	for _, line := range bytes.Split(data[:headerSize(data)], []byte("\n")) {
+		if len(line) >= 9 && bytes.EqualFold(line[:9], []byte("Received:")) {
+			count++
+		}
+	}
+	return count
+}
+
+// checkHops rejects a message with more than max Received fields, whoever
+// added them. A max of zero disables the check.
+func checkHops(data []byte, max int) error {
+	if max > 0 && countReceived(data) > max {
+		return smtpd.Error{Code: 554, Message: "5.4.6 Routing loop detected, too many hops"}
+	}
+	return nil
+}
+
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+	time.RFC3339,
+}
+
+// parseDate parses a Date header leniently, ignoring a trailing comment such
+// as "(UTC)" and accepting a few common non-RFC forms.
+func parseDate(value string) (time.Time, error) {
+	if t, err := mail.ParseDate(value); err == nil {
+		return t, nil
+	}
+
+	if ix := strings.Index(value, "("); ix > 0 {
+		value = value[:ix]
+	}
+	value = strings.Join(strings.Fields(value), " ")
+
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("unparseable date " + value)
+}
+
+// checkDate describes what is wrong with the Date header, or returns "" when
+// it is present and within skew of now.
+func checkDate(header mail.Header, now time.Time, skew time.Duration) string {
+	value := header.Get("Date")
+	if value == "" {
+		return "missing Date header"
+	}
+
+	t, err := parseDate(value)
+	if err != nil {
+		return "unparseable Date header"
+	}
+
+	if t.Before(now.Add(-skew)) || t.After(now.Add(skew)) {
+		return "Date header outside allowed skew"
+	}
+	return ""
+}
+
+// addUnsubscribe prepends one-click List-Unsubscribe headers. The endpoint
+// may contain {list} and {rcpt}, replaced by the escaped alias source and
+// destination.
+func addUnsubscribe(data []byte, endpoint string, list string, destination string) []byte {
+	link := strings.NewReplacer(
+		"{list}", url.QueryEscape(list),
+		"{rcpt}", url.QueryEscape(destination),
+	).Replace(endpoint)
+
+	header := "List-Unsubscribe: <" + link + ">\r\n" +
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"
+
+	return append([]byte(header), data...)
+}
+
+// receivedHeader builds the RFC 5321 trace header for a message received
+// from peer, folded one clause per line. The protocol follows RFC 3848, so
+// TLS and authenticated sessions show as ESMTPS and ESMTPSA.
+func receivedHeader(peer smtpd.Peer, host string, now time.Time) []byte {
+	ip := ""
+	if peer.Addr != nil {
+		ip = peer.Addr.String()
+		if h, _, err := net.SplitHostPort(ip); err == nil {
+			ip = h
+		}
+	}
+	if strings.Contains(ip, ":") {
+		ip = "IPv6:" + ip
+	}
+
+	helo := peer.HeloName
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	protocol := string(peer.Protocol)
+	if protocol == "" {
+		protocol = "SMTP"
+	}
+	if peer.TLS != nil {
+		protocol += "S"
+	}
+	if peer.Username != "" {
+		protocol += "A"
+	}
+
+	header := "Received: from " + helo + " ([" + ip + "])\r\n" +
+		"\tby " + host + " (relayd) with " + protocol
+	if peer.TLS != nil {
+		header += "\r\n\t(version=" + tlsVersionName(peer.TLS) + " cipher=" + tls.CipherSuiteName(peer.TLS.CipherSuite) + ")"
+	}
+	header += ";\r\n\t" + now.Format(time.RFC1123Z) + "\r\n"
+
+	return []byte(header)
+}
+
+// spfHeaders builds the Received-SPF (RFC 7208) and Authentication-Results
+// (RFC 8601) headers recording the SPF result for a message from ip. The
+// null sender is checked and reported by its HELO name.
+func spfHeaders(host string, result string, ip net.IP, sender string, helo string) []byte {
+	identity, property := sender, "smtp.mailfrom"
+	if sender == "" {
+		identity, property = "postmaster@"+helo, "smtp.helo"
+	}
+
+	var comment string
+	switch result {
+	case spfPass:
+		comment = "domain of " + identity + " designates " + ip.String() + " as permitted sender"
+	case spfFail, spfSoftFail:
+		comment = "domain of " + identity + " does not designate " + ip.String() + " as permitted sender"
+	case spfNone:
+		comment = "domain of " + identity + " does not publish SPF"
+	default:
+		comment = "SPF " + result + " for " + identity
+	}
+
+	value := sender
+	if sender == "" {
+		value = helo
+	}
+
+	return []byte("Received-SPF: " + result + " (" + host + ": " + comment + ")\r\n" +
+		"\tclient-ip=" + ip.String() + "; envelope-from=\"" + sender + "\"; helo=" + helo + ";\r\n" +
+		"Authentication-Results: " + host + ";\r\n" +
+		"\tspf=" + result + " " + property + "=" + value + "\r\n")
+}
+
+// aligned reports whether two domains are equal or one is a subdomain of the
+// other, a relaxed form of DMARC identifier alignment.
+func aligned(a string, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// misaligned reports whether the envelope sender's domain, which it returns,
+// fails to align with the From header's domain. Null senders, peers that
+// authenticated by password or a verified client certificate and
+// trustedDomains are exempt.
+func misaligned(peer smtpd.Peer, sender string, fromDomain string, trustedDomains []string) (string, bool) {
+	if sender == "" || peer.Username != "" || (peer.TLS != nil && len(peer.TLS.VerifiedChains) > 0) {
+		return "", false
+	}
+
+	senderDomain := strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+	for _, domain := range trustedDomains {
+		if strings.EqualFold(domain, senderDomain) {
+			return senderDomain, false
+		}
+	}
+	return senderDomain, !aligned(senderDomain, fromDomain)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHopsForeignReceived(t *testing.T) {
+	var message strings.Builder
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&message, "Received: from mx%d.elsewhere.example\r\n\tby mx%d.elsewhere.example; Wed, 14 Oct 2026 12:00:00 +0000\r\n", i, i+1)
+	}
+	message.WriteString("Subject: looping\r\n\r\nReceived: in the body does not count\r\n")
+	data := []byte(message.String())
+
+	if hops := countReceived(data); hops != 30 {
+		t.Errorf("countReceived = %d, want 30", hops)
+	}
+	err := checkHops(data, 25)
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 554 || !strings.HasPrefix(smtpErr.Message, "5.4.6") {
+		t.Errorf("30 foreign hops over a limit of 25: got %v, want 554 5.4.6", err)
+	}
+	if err = checkHops(data, 30); err != nil {
+		t.Errorf("30 hops at a limit of 30: %v", err)
+	}
+	if err = checkHops(data, 0); err != nil {
+		t.Errorf("hop check without a limit: %v", err)
+	}
+}
+
+func TestCheckHeaderSizeOversized(t *testing.T) {
+	body := "\r\n" + strings.Repeat("a long body line that doesn't count\r\n", 1000)
+	oversized := []byte("Subject: big\r\nX-Padding: " + strings.Repeat("x", 10000) + "\r\n" + body)
+
+	err := checkHeaderSize(oversized, 8192)
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 552 || !strings.HasPrefix(smtpErr.Message, "5.3.4") {
+		t.Errorf("10kB header block over an 8kB limit: got %v, want 552 5.3.4", err)
+	}
+	if err = checkHeaderSize([]byte("Subject: small\r\n"+body), 8192); err != nil {
+		t.Errorf("small headers with a large body rejected: %v", err)
+	}
+	if err = checkHeaderSize([]byte("Subject: big\n"+strings.Repeat("X-Padding: x\n", 1000)+"\nbody\n"), 8192); err == nil {
+		t.Error("oversized header block with bare newlines accepted")
+	}
+	if err = checkHeaderSize(oversized, 0); err != nil {
+		t.Errorf("header size check without a limit: %v", err)
+	}
+}
+
+func TestCheckDate(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	skew := 7 * 24 * time.Hour
+
+	for _, test := range []struct {
+		date    string
+		problem string
+	}{
+		{"Wed, 14 Oct 2026 13:30:00 +0200", ""},
+		{"Wed, 14 Oct 2026 11:00:00 GMT (UTC)", ""},
+		{"14 Oct 2026 08:00:00 -0400", ""},
+		{"2026-10-13T09:00:00Z", ""},
+		{"Mon, 28 Sep 2026 12:00:00 +0000", "Date header outside allowed skew"},
+		{"Mon, 26 Oct 2026 12:00:00 +0000", "Date header outside allowed skew"},
+		{"", "missing Date header"},
+		{"last Tuesday", "unparseable Date header"},
+	} {
+		message := "Subject: hi\r\n"
+		if test.date != "" {
+			message += "Date: " + test.date + "\r\n"
+		}
+		header, err := messageHeader([]byte(message + "\r\nhi\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem := checkDate(header, now, skew); problem != test.problem {
+			t.Errorf("checkDate(%q) = %q, want %q", test.date, problem, test.problem)
+		}
+	}
+}
+
+func TestAddUnsubscribeForListAlias(t *testing.T) {
+	aliases, err := parseAliasLines([]byte("news@example.com a@example.org,b@example.net list\n"))
+	if err != nil || len(aliases) != 1 || !aliases[0].List {
+		t.Fatalf("list alias parsed as %+v, %v", aliases, err)
+	}
+
+	data := addUnsubscribe([]byte("Subject: news\r\n\r\nhi\r\n"), "https://lists.example.com/unsub?list={list}&rcpt={rcpt}", aliases[0].Source, "b+news@example.net")
+	header, err := messageHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Get("List-Unsubscribe"), "<https://lists.example.com/unsub?list=news%40example.com&rcpt=b%2Bnews%40example.net>"; got != want {
+		t.Errorf("List-Unsubscribe = %q, want %q", got, want)
+	}
+	if got := header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q, want one-click", got)
+	}
+	if header.Get("Subject") != "news" || !strings.HasSuffix(string(data), "\r\n\r\nhi\r\n") {
+		t.Errorf("adding the headers changed the message: %q", data)
+	}
+}
+
+func TestMisaligned(t *testing.T) {
+	anonymous := smtpd.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25}}
+	authenticated := anonymous
+	authenticated.Username = "alice"
+
+	for _, test := range []struct {
+		peer       smtpd.Peer
+		sender     string
+		from       string
+		misaligned bool
+	}{
+		{anonymous, "alice@example.com", "example.com", false},
+		{anonymous, "bounces@mail.example.com", "example.com", false},
+		{anonymous, "alice@Example.COM", "example.com", false},
+		{anonymous, "alice@example.com", "bank.example", true},
+		{anonymous, "alice@example.com", "", true},
+		{anonymous, "", "bank.example", false},
+		{authenticated, "alice@example.com", "bank.example", false},
+		{anonymous, "alice@trusted.example", "bank.example", false},
+	} {
+		if _, got := misaligned(test.peer, test.sender, test.from, []string{"Trusted.example"}); got != test.misaligned {
+			t.Errorf("misaligned(%q, %q) by %q = %v, want %v", test.sender, test.from, test.peer.Username, got, test.misaligned)
+		}
+	}
+
+	// a client certificate counts as authentication once it's verified
+	client := testCertificate(t, "submit.example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(client.Leaf)
+	for _, test := range []struct {
+		auth       tls.ClientAuthType
+		misaligned bool
+	}{
+		{tls.RequireAndVerifyClientCert, false},
+		{tls.RequireAnyClientCert, true},
+	} {
+		state, err := handshake(t, &tls.Config{
+			Certificates: []tls.Certificate{testCertificate(t, "relay.example.net")},
+			ClientAuth:   test.auth,
+			ClientCAs:    roots,
+		}, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{client}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		certified := anonymous
+		certified.TLS = &state
+		if _, got := misaligned(certified, "alice@example.com", "bank.example", nil); got != test.misaligned {
+			t.Errorf("misaligned with a client certificate under %v = %v, want %v", test.auth, got, test.misaligned)
+		}
+	}
+}
+
+func TestGroupAddressHeaders(t *testing.T) {
+	for value, group := range map[string]bool{
+		"undisclosed-recipients:;":                     true,
+		"Friends: alice@example.com, bob@example.org;": true,
+		"Empty group : ;":                              true,
+		"alice@example.com":                            false,
+		`"Team: Ops" <ops@example.com>`:                false,
+		"Ops (shift: night) <ops@example.com>":         false,
+		"<ops:team@example.com>":                       false,
+	} {
+		if got := isGroup(value); got != group {
+			t.Errorf("isGroup(%q) = %v, want %v", value, got, group)
+		}
+	}
+
+	data := []byte("Received: from a by b; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+		"From: Friends: alice@example.com, bob@example.org;\r\n" +
+		"To: undisclosed-recipients:;\r\n" +
+		"Subject: group\r\n\r\nbody\r\n")
+	header, err := messageHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no member of a group is attributed as the author
+	if domain := headerDomain(header, "From"); domain != "" {
+		t.Errorf("From domain of a group = %q, want none", domain)
+	}
+	if domain := headerDomain(header, "To"); domain != "" {
+		t.Errorf("To domain of an empty group = %q, want none", domain)
+	}
+	if err := checkHops(data, 5); err != nil {
+		t.Errorf("loop detection on a group-addressed message: %v", err)
+	}
+
+	rewritten := addUnsubscribe(data, "mailto:leave@example.com", "list@example.com", "alice@example.org")
+	header, err = messageHeader(rewritten)
+	if err != nil || header.Get("To") != "undisclosed-recipients:;" || header.Get("List-Unsubscribe") == "" {
+		t.Errorf("rewritten headers %v, %v, want the group kept and List-Unsubscribe added", header, err)
+	}
+}
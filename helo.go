@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"log"
+	"net"
+	"strings"
+)
+
+// checkHelo applies the HeloReject policies to the name a client announced:
+// "literal" rejects address literals, "localhost" rejects localhost and
+// loopback names, and "unresolvable" rejects names without an A or AAAA
+// record, deferring when the lookup itself fails temporarily.
+func checkHelo(peer smtpd.Peer, name string, policies []string) error {
+	log.Printf("helo %q from %v", name, peer.Addr)
+
+	for _, policy := range policies {
+		switch policy {
+		case "literal":
+			if isAddressLiteral(name) {
+				return heloRejected(peer, name, "address literal not accepted")
+			}
+		case "localhost":
+			lower := strings.ToLower(strings.TrimSuffix(name, "."))
+			if lower == "localhost" || strings.HasSuffix(lower, ".localhost") || lower == "localhost.localdomain" {
+				return heloRejected(peer, name, "localhost not accepted")
+			}
+		case "unresolvable":
+			if isAddressLiteral(name) {
+				continue
+			}
+			if _, err := net.LookupHost(name); err != nil {
+				if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsTemporary {
+					log.Printf("deferring helo %q from %v: %v", name, peer.Addr, err)
+					return smtpd.Error{Code: 450, Message: "4.7.1 Unable to resolve HELO name, try again later"}
+				}
+				return heloRejected(peer, name, "name does not resolve")
+			}
+		}
+	}
+
+	return nil
+}
+
+func isAddressLiteral(name string) bool {
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		return true
+	}
+	return net.ParseIP(name) != nil
+}
+
+func heloRejected(peer smtpd.Peer, name string, reason string) error {
+	log.Printf("rejecting helo %q from %v: %s", name, peer.Addr, reason)
+	return smtpd.Error{Code: 550, Message: "5.7.1 HELO " + reason}
+}
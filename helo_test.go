@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceivedHeaderHelo(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	peer := smtpd.Peer{
+		HeloName: "mail.client.example",
+		Protocol: smtpd.ESMTP,
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000},
+		TLS:      &tls.ConnectionState{},
+	}
+	header := string(receivedHeader(peer, "relay.example.net", now))
+	for _, want := range []string{"from mail.client.example", "[192.0.2.10]", "by relay.example.net", "with ESMTPS", "Fri, 01 Mar 2024 12:00:00 +0000"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("Received header %q lacks %q", header, want)
+		}
+	}
+
+	header = string(receivedHeader(smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}}, "relay.example.net", now))
+	if !strings.Contains(header, "from unknown") || !strings.Contains(header, "[IPv6:2001:db8::1]") {
+		t.Errorf("Received header without HELO %q, want unknown and the IPv6 literal", header)
+	}
+}
+
+func TestCheckHeloPolicies(t *testing.T) {
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}}
+	all := []string{"literal", "localhost", "unresolvable"}
+
+	for _, test := range []struct {
+		name     string
+		policies []string
+		reason   string
+	}{
+		{"[192.0.2.10]", []string{"literal"}, "5.7.1 HELO address literal not accepted"},
+		{"192.0.2.10", []string{"literal"}, "5.7.1 HELO address literal not accepted"},
+		{"[192.0.2.10]", []string{"localhost", "unresolvable"}, ""},
+		{"localhost", []string{"localhost"}, "5.7.1 HELO localhost not accepted"},
+		{"mail.localhost.", []string{"localhost"}, "5.7.1 HELO localhost not accepted"},
+		{"localhost", []string{"literal", "unresolvable"}, ""},
+		{"mail.client.example", nil, ""},
+	} {
+		err := checkHelo(peer, test.name, test.policies)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("helo %q with %v: got %v", test.name, test.policies, err)
+			}
+			continue
+		}
+		if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 550 || smtpErr.Message != test.reason {
+			t.Errorf("helo %q with %v: got %v, want 550 %s", test.name, test.policies, err, test.reason)
+		}
+	}
+
+	// rejected outright, or deferred where DNS is unavailable
+	if err := checkHelo(peer, "no-such-host.invalid", all); err == nil {
+		t.Error("unresolvable helo accepted")
+	}
+}
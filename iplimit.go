@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// ipLimitListener turns away connections from a source IP that already has
+// max sessions open, answering 421 so the client retries later. The count
+// drops as each connection closes.
+type ipLimitListener struct {
+	net.Listener
+	sync.Mutex
+	max    int
+	active map[string]int
+}
+
+type ipLimitConn struct {
+	net.Conn
+	limiter *ipLimitListener
+	ip      string
+	once    sync.Once
+}
+
+func newIPLimitListener(l net.Listener, max int) *ipLimitListener {
+	return &ipLimitListener{Listener: l, max: max, active: make(map[string]int)}
+}
+
+func (l *ipLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		l.Lock()
+		if l.active[ip] >= l.max {
+			l.Unlock()
+			log.Println("too many concurrent connections from", ip)
+			conn.Write([]byte("421 4.7.0 Too many concurrent connections from your address\r\n"))
+			conn.Close()
+			continue
+		}
+		l.active[ip]++
+		l.Unlock()
+
+		return &ipLimitConn{Conn: conn, limiter: l, ip: ip}, nil
+	}
+}
+
+func (c *ipLimitConn) Close() error {
+	c.once.Do(func() {
+		c.limiter.Lock()
+		if c.limiter.active[c.ip]--; c.limiter.active[c.ip] <= 0 {
+			delete(c.limiter.active, c.ip)
+		}
+		c.limiter.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPLimitListener(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newIPLimitListener(socket, 2)
+	defer limiter.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := limiter.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// dial connects and returns the server's first line, or "" when it
+	// says nothing because the session was let in
+	dial := func() string {
+		client, err := net.Dial("tcp", socket.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		return line
+	}
+
+	for i := 0; i < 2; i++ {
+		if line := dial(); line != "" {
+			t.Fatalf("connection %d within the cap got %q", i+1, line)
+		}
+	}
+	first := <-accepted
+	<-accepted
+
+	if line := dial(); !strings.HasPrefix(line, "421 4.7.0") {
+		t.Errorf("connection over the cap got %q, want a 421", line)
+	}
+
+	// a slot frees up once a session closes
+	first.Close()
+	first.Close()
+	if line := dial(); line != "" {
+		t.Errorf("connection after one closed got %q, want it let in", line)
+	}
+	<-accepted
+
+	limiter.Lock()
+	active := limiter.active["127.0.0.1"]
+	limiter.Unlock()
+	if active != 2 {
+		t.Errorf("%d connections counted for 127.0.0.1, want 2", active)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ListenerConfig struct {
+	Address string
+	Tls     string
+}
+
+// multiListener merges several listeners into one so a single smtpd server,
+// connection tracker and drain cover all of them. It remembers which
+// listener each open connection came in on so TLS can be enforced per
+// listener.
+type multiListener struct {
+	listeners []net.Listener
+	force     []bool
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan bool
+	once  sync.Once
+
+	sync.Mutex
+	open map[string]*listenerConn
+}
+
+type listenerConn struct {
+	net.Conn
+	multi    *multiListener
+	force    bool
+	once     sync.Once
+	starttls int32
+}
+
+func newMultiListener(listeners []net.Listener, force []bool) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		force:     force,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan bool),
+		open:      make(map[string]*listenerConn),
+	}
+	for i := range listeners {
+		go m.acceptLoop(i)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(i int) {
+	for {
+		conn, err := m.listeners[i].Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		lc := &listenerConn{Conn: conn, multi: m, force: m.force[i]}
+		m.Lock()
+		m.open[conn.RemoteAddr().String()] = lc
+		m.Unlock()
+
+		select {
+		case m.conns <- lc:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if closeErr := l.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// ForceTLS reports whether the listener the connection from addr arrived on
+// requires TLS.
+func (m *multiListener) ForceTLS(addr net.Addr) bool {
+	m.Lock()
+	defer m.Unlock()
+	conn, ok := m.open[addr.String()]
+	return ok && conn.force
+}
+
+// ExpectSTARTTLS has the connection of a cleartext peer on a listener
+// requiring TLS closed unless the next command it sends is STARTTLS. It is
+// called after HELO or EHLO.
+func (m *multiListener) ExpectSTARTTLS(peer smtpd.Peer) {
+	if peer.TLS != nil {
+		return
+	}
+	m.Lock()
+	conn, ok := m.open[peer.Addr.String()]
+	m.Unlock()
+	if ok && conn.force {
+		atomic.StoreInt32(&conn.starttls, 1)
+	}
+}
+
+func (c *listenerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && atomic.CompareAndSwapInt32(&c.starttls, 1, 0) && !strings.HasPrefix(strings.ToUpper(string(p[:n])), "STARTTLS") {
+		log.Println("dropping cleartext client", c.RemoteAddr(), "that didn't issue STARTTLS after EHLO")
+		c.Close()
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *listenerConn) Close() error {
+	c.once.Do(func() {
+		c.multi.Lock()
+		delete(c.multi.open, c.RemoteAddr().String())
+		c.multi.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// checkCleartext refuses MAIL from a peer that arrived on a listener
+// requiring TLS without issuing STARTTLS. With policy "drop" the connection
+// is closed right after the reply, for a client that pipelined MAIL after
+// EHLO; otherwise the client may linger.
+func checkCleartext(m *multiListener, tracker *connTracker, policy string, peer smtpd.Peer) error {
+	if !m.ForceTLS(peer.Addr) || peer.TLS != nil {
+		return nil
+	}
+
+	log.Println("rejecting cleartext MAIL from", peer.Addr)
+	if policy == "drop" && tracker != nil {
+		tracker.Drop(peer.Addr, 100*time.Millisecond)
+	}
+	return smtpd.Error{Code: 530, Message: "5.7.0 TLS required, issue STARTTLS first"}
+}
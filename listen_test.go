@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCleartextOnForceTLSListener(t *testing.T) {
+	var sockets []net.Listener
+	for i := 0; i < 2; i++ {
+		socket, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sockets = append(sockets, socket)
+	}
+	listeners := newMultiListener(sockets, []bool{true, false})
+	tracker := newConnTracker(listeners)
+	defer tracker.Close()
+
+	connect := func(socket net.Listener) (net.Conn, smtpd.Peer) {
+		client, err := net.Dial("tcp", socket.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		conn, err := tracker.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, smtpd.Peer{Addr: conn.RemoteAddr(), HeloName: "client.example.com"}
+	}
+	// closed reports whether the server closed the client's connection
+	// within wait
+	closed := func(client net.Conn, wait time.Duration) bool {
+		client.SetReadDeadline(time.Now().Add(wait))
+		_, err := client.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false
+		}
+		return err != nil
+	}
+	required := func(err error) bool {
+		smtpErr, ok := err.(smtpd.Error)
+		return ok && smtpErr.Code == 530 && strings.Contains(smtpErr.Message, "TLS required")
+	}
+
+	client, peer := connect(sockets[0])
+	if err := checkCleartext(listeners, tracker, "", peer); !required(err) {
+		t.Errorf("cleartext MAIL on the ForceTLS listener: got %v, want a 530 saying TLS is required", err)
+	}
+	if closed(client, 300*time.Millisecond) {
+		t.Error("connection dropped without TlsPolicy drop")
+	}
+
+	client, peer = connect(sockets[0])
+	if err := checkCleartext(listeners, tracker, "drop", peer); !required(err) {
+		t.Errorf("cleartext MAIL with TlsPolicy drop: got %v, want a 530 saying TLS is required", err)
+	}
+	if !closed(client, 2*time.Second) {
+		t.Error("connection still open after the 530 with TlsPolicy drop")
+	}
+
+	_, peer = connect(sockets[0])
+	peer.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	if err := checkCleartext(listeners, tracker, "drop", peer); err != nil {
+		t.Errorf("MAIL after STARTTLS: got %v", err)
+	}
+
+	_, peer = connect(sockets[1])
+	if err := checkCleartext(listeners, tracker, "drop", peer); err != nil {
+		t.Errorf("cleartext MAIL on a listener without ForceTLS: got %v", err)
+	}
+}
+
+func TestExpectSTARTTLSAfterEhlo(t *testing.T) {
+	var sockets []net.Listener
+	for i := 0; i < 2; i++ {
+		socket, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sockets = append(sockets, socket)
+	}
+	listeners := newMultiListener(sockets, []bool{true, false})
+	defer listeners.Close()
+
+	// next sends command from a client that just had its EHLO answered
+	// and returns what the server reads of it
+	next := func(socket net.Listener, command string) (string, error) {
+		client, err := net.Dial("tcp", socket.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := listeners.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		listeners.ExpectSTARTTLS(smtpd.Peer{Addr: conn.RemoteAddr(), HeloName: "client.example.com"})
+		client.Write([]byte(command))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			// the client sees the connection closed too
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if _, readErr := client.Read(buf); readErr == nil {
+				t.Error("client connection still open after the drop")
+			}
+		}
+		return string(buf[:n]), err
+	}
+
+	if got, err := next(sockets[0], "MAIL FROM:<sender@example.com>\r\n"); err == nil {
+		t.Errorf("cleartext client on the ForceTLS listener sent %q after EHLO and wasn't dropped", got)
+	}
+	if got, err := next(sockets[0], "starttls\r\n"); err != nil || got != "starttls\r\n" {
+		t.Errorf("STARTTLS after EHLO read as %q, %v", got, err)
+	}
+	if got, err := next(sockets[1], "MAIL FROM:<sender@example.com>\r\n"); err != nil || !strings.HasPrefix(got, "MAIL") {
+		t.Errorf("cleartext MAIL on a listener without ForceTLS read as %q, %v", got, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// events receives structured events such as deliveries. The log package's
+// lines go through it too, at info level, so LogLevel applies to them and
+// with LogFormat json everything comes out as one JSON object per line.
+var events = slog.Default()
+
+// logWriter feeds the log package's lines to a structured logger, at warn
+// level for alerts.
+type logWriter struct {
+	logger *slog.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := slog.LevelInfo
+	if strings.Contains(msg, "ALERT:") {
+		level = slog.LevelWarn
+	}
+	w.logger.Log(context.Background(), level, msg)
+	return len(p), nil
+}
+
+// openLogTarget returns where logs go for LogTarget: stderr, file:<path>,
+// or syslog with an optional :facility. It reports whether the target
+// timestamps lines itself.
+func openLogTarget(target string) (io.Writer, bool, error) {
+	switch {
+	case target == "" || target == "stderr":
+		return os.Stderr, false, nil
+	case strings.HasPrefix(target, "file:"):
+		file, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, false, err
+		}
+		return file, false, nil
+	case target == "syslog" || strings.HasPrefix(target, "syslog:"):
+		writer, err := openSyslog(strings.TrimPrefix(strings.TrimPrefix(target, "syslog"), ":"))
+		if err != nil {
+			return nil, false, err
+		}
+		return writer, true, nil
+	}
+	return nil, false, errors.New("invalid log target " + target)
+}
+
+func setupLogging(format string, level string, target string) error {
+	var threshold slog.Level
+	switch level {
+	case "", "info":
+		threshold = slog.LevelInfo
+	case "debug":
+		threshold = slog.LevelDebug
+	case "warn":
+		threshold = slog.LevelWarn
+	case "error":
+		threshold = slog.LevelError
+	default:
+		return errors.New("invalid log level " + level)
+	}
+
+	writer, stamped, err := openLogTarget(target)
+	if err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: threshold}
+	switch format {
+	case "", "text":
+		if stamped {
+			options.ReplaceAttr = dropTime
+		}
+		events = slog.New(slog.NewTextHandler(writer, options))
+	case "json":
+		events = slog.New(slog.NewJSONHandler(writer, options))
+	default:
+		return errors.New("invalid log format " + format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logWriter{events})
+	return nil
+}
+
+// dropTime leaves the timestamp to a target that adds its own.
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// logDelivery records the outcome of one delivery attempt.
+func logDelivery(recipient string, destination string, mxHost string, duration time.Duration, err error) {
+	if err == nil {
+		events.Info("delivery", "recipient", recipient, "destination", destination, "mx_host", mxHost,
+			"duration_ms", duration.Milliseconds(), "status", "delivered")
+		return
+	}
+
+	status, level := "failed", slog.LevelError
+	if temporaryError(err) {
+		status, level = "deferred", slog.LevelWarn
+	}
+	events.Log(context.Background(), level, "delivery", "recipient", recipient, "destination", destination, "mx_host", mxHost,
+		"duration_ms", duration.Milliseconds(), "status", status, "error", err.Error())
+}
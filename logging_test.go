@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenLogTargetSyslogError(t *testing.T) {
+	writer, _, err := openLogTarget("syslog:nonesuch")
+	if err == nil || !strings.Contains(err.Error(), "nonesuch") {
+		t.Errorf("syslog with an unknown facility gave writer %v, error %v; want the syslog error", writer, err)
+	}
+}
+
+func TestTextLogLevelAppliesToLogLines(t *testing.T) {
+	defer func(l *slog.Logger) { events = l }(events)
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+
+	path := filepath.Join(t.TempDir(), "relayd.log")
+	if err := setupLogging("text", "warn", "file:"+path); err != nil {
+		t.Fatal(err)
+	}
+	log.Println("queued delivery to user@example.org")
+	log.Println("ALERT: failed to queue bounce")
+	events.Info("delivery", "status", "delivered")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "queued delivery") || strings.Contains(string(data), "delivered") {
+		t.Errorf("info lines logged at LogLevel warn:\n%s", data)
+	}
+	if !strings.Contains(string(data), "level=WARN") || !strings.Contains(string(data), "ALERT: failed to queue bounce") {
+		t.Errorf("alert missing at LogLevel warn:\n%s", data)
+	}
+}
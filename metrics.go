@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	messages_received = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "relayd_messages_received_total",
+		Help: "Messages accepted for relaying.",
+	})
+	messages_delivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "relayd_messages_delivered_total",
+		Help: "Deliveries accepted by an upstream.",
+	})
+	deliveries_failed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_deliveries_failed_total",
+		Help: "Failed deliveries by error class.",
+	}, []string{"class"})
+	alias_misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "relayd_alias_lookup_misses_total",
+		Help: "Recipients with no matching alias.",
+	})
+	alias_table_size = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relayd_alias_table_size",
+		Help: "Entries in the last alias table fetched from each source.",
+	}, []string{"source"})
+	alias_reloads_held = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_alias_reloads_held_total",
+		Help: "Alias reloads held back for changing more than MaxChange of the table, by source.",
+	}, []string{"source"})
+	spf_results = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_spf_results_total",
+		Help: "SPF checks of inbound senders by result.",
+	}, []string{"result"})
+	tenant_messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_tenant_messages_delivered_total",
+		Help: "Deliveries per tenant, counted when usage accounting is enabled.",
+	}, []string{"tenant"})
+	tenant_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_tenant_bytes_delivered_total",
+		Help: "Message bytes delivered per tenant, counted when usage accounting is enabled.",
+	}, []string{"tenant"})
+	protocol_violations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "relayd_protocol_violations_total",
+		Help: "Commands sent out of sequence, by kind.",
+	}, []string{"kind"})
+	spool_free_bytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "relayd_spool_free_bytes",
+		Help: "Bytes free on the spool's filesystem, when MinFreeSpace is set.",
+	})
+	spool_low = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "relayd_spool_low",
+		Help: "1 while free space on the spool is below MinFreeSpace and new mail is deferred.",
+	})
+	delivery_latency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "relayd_delivery_duration_seconds",
+		Help:    "Time spent delivering to an upstream.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(messages_received, messages_delivered, deliveries_failed,
+		alias_misses, alias_table_size, alias_reloads_held, spf_results, tenant_messages, tenant_bytes,
+		protocol_violations, spool_free_bytes, spool_low, delivery_latency)
+}
+
+// failureClass buckets a delivery error for the failure counter.
+func failureClass(err error) string {
+	switch err.(type) {
+	case *connectError:
+		return "connect"
+	case *handshakeError:
+		return "tls"
+	}
+	if err == errNullMX {
+		return "null_mx"
+	}
+	if temporaryError(err) {
+		return "temporary"
+	}
+	return "permanent"
+}
+
+// metricsSource labels an alias source without credentials or query
+// parameters, which often carry tokens.
+func metricsSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "invalid"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// healthz answers 200 while the alias set is healthy and the spool has
+// space, and 503 with the reason otherwise.
+func healthz(aliases *AliasSet, maxAge time.Duration, disk *diskWatermark) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := aliases.Health(maxAge); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if disk.Accept() != nil {
+			http.Error(w, "spool free space below MinFreeSpace", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+func startHealth(bind string, health http.HandlerFunc) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health)
+
+	log.Println("health check listening on " + bind)
+	go func() {
+		log.Fatal(http.ListenAndServe(bind, mux))
+	}()
+}
+
+func startMetrics(bind string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Println("metrics listening on " + bind)
+	go func() {
+		log.Fatal(http.ListenAndServe(bind, mux))
+	}()
+	return mux
+}
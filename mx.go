@@ -0,0 +1,205 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rttEntry struct {
+	rtt     time.Duration
+	expires time.Time
+}
+
+var rtt_cache = struct {
+	sync.Mutex
+	entries map[string]rttEntry
+}{entries: make(map[string]rttEntry)}
+
+type mxEntry struct {
+	groups  [][]string
+	err     error
+	expires time.Time
+}
+
+var mx_cache = struct {
+	sync.Mutex
+	entries map[string]mxEntry
+}{entries: make(map[string]mxEntry)}
+
+// MX answers are cached for their TTL, clamped to these bounds so a zero TTL
+// doesn't mean a query per message and a huge one doesn't pin a stale route.
+var mx_ttl_min = time.Minute
+var mx_ttl_max = time.Hour
+
+func cachedMX(domain string) (mxEntry, bool) {
+	mx_cache.Lock()
+	defer mx_cache.Unlock()
+
+	entry, ok := mx_cache.entries[strings.ToLower(domain)]
+	if !ok || !time.Now().Before(entry.expires) {
+		return mxEntry{}, false
+	}
+	return entry, true
+}
+
+func cacheMX(domain string, groups [][]string, err error, ttl uint32) {
+	lifetime := time.Duration(ttl) * time.Second
+	if lifetime < mx_ttl_min {
+		lifetime = mx_ttl_min
+	}
+	if lifetime > mx_ttl_max {
+		lifetime = mx_ttl_max
+	}
+
+	mx_cache.Lock()
+	defer mx_cache.Unlock()
+
+	now := time.Now()
+	for key, entry := range mx_cache.entries {
+		if !now.Before(entry.expires) {
+			delete(mx_cache.entries, key)
+		}
+	}
+	mx_cache.entries[strings.ToLower(domain)] = mxEntry{groups, err, now.Add(lifetime)}
+}
+
+// probeRTT measures the time to open a TCP connection to host's SMTP port,
+// caching the result for ten minutes. Unreachable hosts get the maximum
+// duration so they sort last.
+func probeRTT(host string) time.Duration {
+	rtt_cache.Lock()
+	entry, ok := rtt_cache.entries[host]
+	rtt_cache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.rtt
+	}
+
+	rtt := time.Duration(1<<63 - 1)
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "25"), 5*time.Second)
+	if err == nil {
+		rtt = time.Since(start)
+		conn.Close()
+	}
+
+	rtt_cache.Lock()
+	rtt_cache.entries[host] = rttEntry{rtt, time.Now().Add(10 * time.Minute)}
+	rtt_cache.Unlock()
+
+	return rtt
+}
+
+// orderMX orders several equal-preference hosts: those matching the region
+// hint first, then by probed RTT when probing is enabled, else shuffled so
+// load spreads across the group.
+func orderMX(hosts []string, region string, probe bool) []string {
+	if len(hosts) == 1 {
+		return hosts
+	}
+
+	ordered := make([]string, len(hosts))
+	copy(ordered, hosts)
+
+	if probe {
+		rtts := make(map[string]time.Duration)
+		for _, host := range ordered {
+			rtts[host] = probeRTT(host)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return rtts[ordered[i]] < rtts[ordered[j]]
+		})
+	} else {
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+
+	if region != "" {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return strings.Contains(ordered[i], region) && !strings.Contains(ordered[j], region)
+		})
+	}
+
+	return ordered
+}
+
+// connectError marks a failure to reach an MX or get its greeting, after
+// which delivery moves on to the next host.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// tryNextMX reports whether delivery moves on to the next MX after err: the
+// host couldn't be reached or failed the TLS policy, which another may meet.
+func tryNextMX(err error) bool {
+	switch err.(type) {
+	case *connectError, *handshakeError:
+		return true
+	}
+	return err == errNoStartTLS
+}
+
+// deliverMX tries each host in order until one accepts the connection and
+// meets the TLS policy. Once one does, its result is final; if none does,
+// the last host's error is returned.
+func deliverMX(sender string, destination string, body []byte, mailhosts []string, trace *deliveryTrace) error {
+	return deliverBatch(sender, []string{destination}, body, mailhosts, trace)[0]
+}
+
+// deliverBatch sends body to destinations in one session, moving on to the
+// next MX while they can't be reached or fail the TLS policy. It returns an
+// error per destination.
+func deliverBatch(sender string, destinations []string, body []byte, mailhosts []string, trace *deliveryTrace) []error {
+	errs := make([]error, len(destinations))
+	for _, mailhost := range mailhosts {
+		errs = deliverMessage(sender, destinations, body, mailhost, trace)
+		if !tryNextMX(errs[0]) {
+			return errs
+		}
+		log.Println("trying next mx for "+strings.Join(destinations, ", ")+" after", errs[0])
+	}
+	return errs
+}
+
+type mxResult struct {
+	Hosts []string
+	Err   error
+}
+
+// resolveMX looks up the MX of every domain, running at most concurrency
+// lookups at a time.
+func resolveMX(domains []string, concurrency int) map[string]mxResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(map[string]mxResult)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan bool, concurrency)
+
+	for _, domain := range domains {
+		wg.Add(1)
+		slots <- true
+		go func(domain string) {
+			defer wg.Done()
+			hosts, err := getMX(domain)
+			mutex.Lock()
+			results[domain] = mxResult{hosts, err}
+			mutex.Unlock()
+			<-slots
+		}(domain)
+	}
+
+	wg.Wait()
+	return results
+}
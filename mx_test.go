@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderMXByRTT(t *testing.T) {
+	hosts := []string{"mx1.eu.example.com", "mx2.us.example.com", "mx3.ap.example.com"}
+	expires := time.Now().Add(time.Minute)
+	rtt_cache.Lock()
+	for host, rtt := range map[string]time.Duration{
+		"mx1.eu.example.com": 80 * time.Millisecond,
+		"mx2.us.example.com": 5 * time.Millisecond,
+		"mx3.ap.example.com": 1<<63 - 1, // unreachable
+	} {
+		rtt_cache.entries[host] = rttEntry{rtt, expires}
+	}
+	rtt_cache.Unlock()
+	defer func() {
+		rtt_cache.Lock()
+		for _, host := range hosts {
+			delete(rtt_cache.entries, host)
+		}
+		rtt_cache.Unlock()
+	}()
+
+	ordered := orderMX(hosts, "", true)
+	if ordered[0] != "mx2.us.example.com" || ordered[1] != "mx1.eu.example.com" || ordered[2] != "mx3.ap.example.com" {
+		t.Errorf("orderMX by RTT = %v, want the closest host first and the unreachable one last", ordered)
+	}
+
+	if ordered = orderMX(hosts, ".eu.", true); ordered[0] != "mx1.eu.example.com" || ordered[1] != "mx2.us.example.com" {
+		t.Errorf("orderMX with region hint .eu. = %v, want the hinted host first, then by RTT", ordered)
+	}
+
+	if ordered = orderMX(hosts, "", false); len(ordered) != 3 || hosts[0] != "mx1.eu.example.com" {
+		t.Errorf("shuffled orderMX = %v, or changed its input %v", ordered, hosts)
+	}
+}
+
+func TestResolveMXConcurrently(t *testing.T) {
+	var mutex sync.Mutex
+	inflight, peak, queries := 0, 0, 0
+	serveDNS(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mutex.Lock()
+		inflight++
+		queries++
+		if inflight > peak {
+			peak = inflight
+		}
+		mutex.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeMX {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN MX 10 mx." + r.Question[0].Name)
+			m.Answer = []dns.RR{rr}
+		}
+		w.WriteMsg(m)
+
+		mutex.Lock()
+		inflight--
+		mutex.Unlock()
+	}))
+
+	var domains []string
+	for i := 0; i < 6; i++ {
+		domains = append(domains, fmt.Sprintf("parallel%d-%d.example", i, time.Now().UnixNano()))
+	}
+
+	start := time.Now()
+	results := resolveMX(domains, 3)
+	elapsed := time.Since(start)
+	for _, domain := range domains {
+		if result := results[domain]; result.Err != nil || len(result.Hosts) != 1 || result.Hosts[0] != "mx."+domain {
+			t.Errorf("MX of %s = %v, %v", domain, result.Hosts, result.Err)
+		}
+	}
+	mutex.Lock()
+	if peak != 3 {
+		t.Errorf("%d lookups ran at once, want the limit of 3", peak)
+	}
+	mutex.Unlock()
+	if elapsed >= 500*time.Millisecond {
+		t.Errorf("6 lookups of 100ms with 3 at a time took %v", elapsed)
+	}
+
+	// answered from the shared cache the second time
+	mutex.Lock()
+	before := queries
+	mutex.Unlock()
+	resolveMX(domains, 3)
+	mutex.Lock()
+	if queries != before {
+		t.Errorf("repeat resolution sent %d queries, want the cached answers used", queries-before)
+	}
+	mutex.Unlock()
+}
+
+func TestMXFailoverByPreference(t *testing.T) {
+	// answered out of preference order
+	fakeDNS(t,
+		"failover.example. 300 IN MX 30 mx3.failover.example.",
+		"failover.example. 300 IN MX 10 mx1.failover.example.",
+		"failover.example. 300 IN MX 20 mx2.failover.example.")
+	hosts, err := getMX("failover.example")
+	if err != nil || len(hosts) != 3 || hosts[0] != "mx1.failover.example" || hosts[1] != "mx2.failover.example" || hosts[2] != "mx3.failover.example" {
+		t.Fatalf("getMX = %v, %v, want every host by preference", hosts, err)
+	}
+
+	// addresses nothing listens on
+	var unreachable []string
+	for i := 0; i < 2; i++ {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		unreachable = append(unreachable, closed.Addr().String())
+		closed.Close()
+	}
+	down := unreachable[1]
+
+	upstream := newFakeUpstream(t)
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+	trace := &deliveryTrace{}
+	errs := deliverBatch("sender@example.com", []string{"user@failover.example"}, body, []string{down, upstream.Addr()}, trace)
+	if errs[0] != nil || trace.Host != upstream.Addr() || len(upstream.Messages()) != 1 {
+		t.Errorf("delivery with the primary down: %v via %q, want it delivered by the next host", errs[0], trace.Host)
+	}
+
+	errs = deliverBatch("sender@example.com", []string{"user@failover.example"}, body, unreachable, nil)
+	connErr, ok := errs[0].(*connectError)
+	if !ok || !strings.Contains(connErr.Error(), down) {
+		t.Errorf("delivery with every host down: got %v, want the last host's connection error", errs[0])
+	}
+}
+
+func TestLookupFailureClasses(t *testing.T) {
+	fakeDNS(t,
+		"implicit.example. 300 IN A 192.0.2.25",
+		"nohost.example. 300 IN TXT \"v=spf1 -all\"")
+
+	if _, err := getMX("nxdomain.example"); err != errNoSuchDomain {
+		t.Errorf("getMX of a missing domain: got %v, want errNoSuchDomain", err)
+	}
+	if hosts, err := getMX("implicit.example"); err != nil || len(hosts) != 1 || hosts[0] != "implicit.example" {
+		t.Errorf("getMX of a domain with only an address = %v, %v, want the domain itself", hosts, err)
+	}
+	if _, err := getMX("nohost.example"); err != errNoMailHost {
+		t.Errorf("getMX of a domain without MX or address: got %v, want errNoMailHost", err)
+	}
+
+	for _, err := range []error{errNoSuchDomain, errNoMailHost, nil} {
+		if failure := lookupFailure("example.org", err); temporaryError(failure) {
+			t.Errorf("lookup giving %v fails temporarily with %v, want a permanent failure", err, failure)
+		}
+	}
+	if failure := lookupFailure("example.org", fmt.Errorf("read udp: i/o timeout")); !temporaryError(failure) {
+		t.Errorf("timed out lookup fails permanently with %v", failure)
+	}
+}
+
+func TestLookupServerFailureIsTemporary(t *testing.T) {
+	serveDNS(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}))
+
+	_, err := getMX("servfail.example")
+	if err == nil || err == errNoSuchDomain {
+		t.Fatalf("getMX on SERVFAIL: got %v, want a lookup error", err)
+	}
+	if failure := lookupFailure("servfail.example", err); !temporaryError(failure) {
+		t.Errorf("SERVFAIL fails permanently with %v, want it retried", failure)
+	}
+	// a failed lookup isn't cached as an answer
+	if _, ok := cachedMX("servfail.example"); ok {
+		t.Error("SERVFAIL cached")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// pregreetListener holds each new connection for delay before smtpd sends
+// its greeting. A client that sends anything in that time is violating the
+// protocol, which spambots do to pipeline blindly; it is logged and, with
+// disconnect set, dropped with a 554.
+type pregreetListener struct {
+	net.Listener
+	delay      time.Duration
+	disconnect bool
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan bool
+	once  sync.Once
+}
+
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func newPregreetListener(l net.Listener, delay time.Duration, disconnect bool) *pregreetListener {
+	p := &pregreetListener{
+		Listener:   l,
+		delay:      delay,
+		disconnect: disconnect,
+		conns:      make(chan net.Conn),
+		errs:       make(chan error),
+		done:       make(chan bool),
+	}
+	go p.acceptLoop()
+	return p
+}
+
+func (p *pregreetListener) acceptLoop() {
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			select {
+			case p.errs <- err:
+			case <-p.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go p.check(conn)
+	}
+}
+
+func (p *pregreetListener) check(conn net.Conn) {
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(p.delay))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+
+	if n > 0 {
+		log.Println("client sent data before greeting", conn.RemoteAddr())
+		if p.disconnect {
+			conn.Write([]byte("554 5.5.1 Protocol violation: data sent before greeting\r\n"))
+			conn.Close()
+			return
+		}
+		conn = &prefixConn{conn, buf[:n]}
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		conn.Close()
+		return
+	}
+
+	select {
+	case p.conns <- conn:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+func (p *pregreetListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (p *pregreetListener) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return p.Listener.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"log"
+	"sync"
+	"time"
+)
+
+// protocolGuard notices clients that break the SMTP command sequence, as
+// spambots do when they pipeline blindly: MAIL or RCPT before HELO or EHLO,
+// or after relayd answered the HELO or MAIL with a 5xx. With policy
+// "penalize" the offending command is refused and the client's rate limit
+// bucket emptied; "disconnect" refuses it and drops the connection. Any
+// other policy only logs and counts violations.
+type protocolGuard struct {
+	sync.Mutex
+	policy   string
+	limiter  *rateLimiter
+	sessions map[string]*sessionState
+}
+
+type sessionState struct {
+	rejected string
+	seen     time.Time
+}
+
+func newProtocolGuard(policy string, limiter *rateLimiter) *protocolGuard {
+	return &protocolGuard{policy: policy, limiter: limiter, sessions: make(map[string]*sessionState)}
+}
+
+// Reply records relayd's answer to command, HELO or MAIL, from peer.
+func (g *protocolGuard) Reply(peer smtpd.Peer, command string, err error) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for key, state := range g.sessions {
+		if now.Sub(state.seen) > time.Hour {
+			delete(g.sessions, key)
+		}
+	}
+
+	key := peer.Addr.String()
+	if smtpErr, ok := err.(smtpd.Error); ok && smtpErr.Code >= 500 {
+		g.sessions[key] = &sessionState{rejected: command, seen: now}
+	} else if state, ok := g.sessions[key]; ok && (command == "HELO" || state.rejected == command) {
+		delete(g.sessions, key)
+	}
+}
+
+// Check reports whether command, MAIL or RCPT, may follow what peer has
+// sent so far, returning the reply for a violation the policy refuses.
+func (g *protocolGuard) Check(peer smtpd.Peer, command string) error {
+	kind, violation := "", ""
+	if peer.HeloName == "" {
+		kind, violation = "before_helo", command+" before HELO"
+	} else {
+		g.Lock()
+		if state, ok := g.sessions[peer.Addr.String()]; ok && (state.rejected == "HELO" || command == "RCPT") {
+			kind, violation = "after_rejection", command+" after rejected "+state.rejected
+		}
+		g.Unlock()
+	}
+	if violation == "" {
+		return nil
+	}
+
+	log.Println("protocol violation from", peer.Addr, violation)
+	protocol_violations.WithLabelValues(kind).Inc()
+
+	switch g.policy {
+	case "penalize", "disconnect":
+		g.limiter.Penalize(peer.Addr)
+		return smtpd.Error{Code: 503, Message: "5.5.1 Bad sequence of commands"}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"net"
+	"testing"
+)
+
+func TestProtocolGuardOutOfOrderBurst(t *testing.T) {
+	limiter := &rateLimiter{rate: 1, burst: 10, buckets: make(map[string]*tokenBucket)}
+	guard := newProtocolGuard("penalize", limiter)
+	before := counterValue(t, "relayd_protocol_violations_total", "kind", "before_helo")
+	after := counterValue(t, "relayd_protocol_violations_total", "kind", "after_rejection")
+
+	// a bot blasting MAIL and RCPT without waiting for the greeting
+	bot := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}}
+	for _, command := range []string{"MAIL", "RCPT", "RCPT"} {
+		if err := guard.Check(bot, command); !isBadSequence(err) {
+			t.Errorf("%s before HELO: got %v, want 503 5.5.1", command, err)
+		}
+	}
+	if limiter.Allow(bot.Addr) {
+		t.Error("rate limiter still allows a client that broke the command sequence")
+	}
+	if got := counterValue(t, "relayd_protocol_violations_total", "kind", "before_helo") - before; got != 3 {
+		t.Errorf("counted %v violations before HELO, want 3", got)
+	}
+
+	// RCPT pipelined after its MAIL was rejected, then a fresh transaction
+	client := smtpd.Peer{HeloName: "mail.example.com", Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.8"), Port: 40001}}
+	guard.Reply(client, "HELO", nil)
+	if err := guard.Check(client, "MAIL"); err != nil {
+		t.Fatalf("MAIL after HELO: %v", err)
+	}
+	guard.Reply(client, "MAIL", smtpd.Error{Code: 550, Message: "5.7.23 SPF validation failed"})
+	if err := guard.Check(client, "RCPT"); !isBadSequence(err) {
+		t.Errorf("RCPT after a rejected MAIL: got %v, want 503 5.5.1", err)
+	}
+	if err := guard.Check(client, "MAIL"); err != nil {
+		t.Errorf("new MAIL after a rejected one: %v", err)
+	}
+	guard.Reply(client, "MAIL", nil)
+	if err := guard.Check(client, "RCPT"); err != nil {
+		t.Errorf("RCPT after an accepted MAIL: %v", err)
+	}
+
+	// a temporary rejection is no reason to stop
+	guard.Reply(client, "MAIL", smtpd.Error{Code: 451, Message: "4.3.2 Not accepting mail at this time"})
+	if err := guard.Check(client, "RCPT"); err != nil {
+		t.Errorf("RCPT after a 451 MAIL: %v", err)
+	}
+
+	// MAIL after a later EHLO was rejected
+	guard.Reply(client, "HELO", smtpd.Error{Code: 550, Message: "5.7.1 localhost not accepted"})
+	if err := guard.Check(client, "MAIL"); !isBadSequence(err) {
+		t.Errorf("MAIL after a rejected HELO: got %v, want 503 5.5.1", err)
+	}
+	if got := counterValue(t, "relayd_protocol_violations_total", "kind", "after_rejection") - after; got != 2 {
+		t.Errorf("counted %v violations after a rejection, want 2", got)
+	}
+
+	// without a refusing policy violations are only counted
+	if err := newProtocolGuard("", limiter).Check(smtpd.Peer{Addr: bot.Addr}, "MAIL"); err != nil {
+		t.Errorf("violation refused without a policy: %v", err)
+	}
+}
+
+func isBadSequence(err error) bool {
+	smtpErr, ok := err.(smtpd.Error)
+	return ok && smtpErr.Code == 503 && smtpErr.Message == "5.5.1 Bad sequence of commands"
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the PROXY protocol v1 or v2 header a load balancer
+// sends ahead of each connection, so the connection reports the real
+// client as its remote address to everything above it. Connections without
+// a valid header are closed. Headers are read off the accept path so a slow
+// client can't hold up others.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	conns   chan net.Conn
+	errs    chan error
+	done    chan bool
+	once    sync.Once
+}
+
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func newProxyListener(l net.Listener, timeout time.Duration) *proxyListener {
+	p := &proxyListener{
+		Listener: l,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan bool),
+	}
+	go p.acceptLoop()
+	return p
+}
+
+func (p *proxyListener) acceptLoop() {
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			select {
+			case p.errs <- err:
+			case <-p.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go p.handshake(conn)
+	}
+}
+
+func (p *proxyListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		log.Println("closing connection from", conn.RemoteAddr(), "with bad proxy header:", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	select {
+	case p.conns <- &proxyConn{conn, reader, remote}:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (p *proxyListener) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return p.Listener.Close()
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader parses a PROXY header, returning the client address or
+// nil when the balancer sent UNKNOWN or LOCAL, such as for health checks.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		return readProxyV1(reader)
+	}
+
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	return nil, errors.New("missing proxy header")
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	// a v1 header is at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed proxy v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.New("malformed proxy v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported proxy v2 version")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.New("unsupported proxy v2 command")
+	}
+
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("short proxy v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("short proxy v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// other families carry no address we can use
+	return nil, nil
+}
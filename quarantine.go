@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotQuarantined = errors.New("no such quarantined item")
+
+// QuarantinedItem describes a held message for review, without its body.
+type QuarantinedItem struct {
+	Id         string
+	Sender     string
+	Recipients []string
+	Size       int
+	Created    time.Time
+	Reason     string
+}
+
+// messageScore reads the score a content scanner in front of relayd put in
+// the name header, such as "X-Spam-Score: 7.3" or "7.3 / 5.0".
+func messageScore(header mail.Header, name string) (float64, bool) {
+	fields := strings.Fields(header.Get(name))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	score, err := strconv.ParseFloat(fields[0], 64)
+	return score, err == nil
+}
+
+func (q *Queue) quarantineDir() string {
+	return filepath.Join(q.dir, "quarantine")
+}
+
+// quarantinePath maps id to its file, refusing anything that would
+// name a file outside the quarantine folder.
+func (q *Queue) quarantinePath(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", errNotQuarantined
+	}
+	return filepath.Join(q.quarantineDir(), id+".json"), nil
+}
+
+// Quarantine holds item for review instead of delivering it; Release
+// hands it to the spool as it was.
+func (q *Queue) Quarantine(item *QueueItem) error {
+	item.Created = time.Now()
+	if err := writeItem(filepath.Join(q.quarantineDir(), itemID(item.Created)+".json"), item); err != nil {
+		return err
+	}
+
+	log.Println("quarantined delivery to "+strings.Join(item.Recipients, ", ")+":", item.LastError)
+	return nil
+}
+
+// Quarantined lists the held items, oldest first.
+func (q *Queue) Quarantined() ([]QuarantinedItem, error) {
+	files, err := ioutil.ReadDir(q.quarantineDir())
+	if err != nil {
+		return nil, err
+	}
+
+	items := []QuarantinedItem{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(q.quarantineDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var item QueueItem
+		if err = json.Unmarshal(data, &item); err != nil {
+			log.Println("skipping unreadable quarantined item "+file.Name(), err)
+			continue
+		}
+		items = append(items, QuarantinedItem{
+			Id:         strings.TrimSuffix(file.Name(), ".json"),
+			Sender:     item.Sender,
+			Recipients: item.Recipients,
+			Size:       item.Size,
+			Created:    item.Created,
+			Reason:     item.LastError,
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.Before(items[j].Created) })
+	return items, nil
+}
+
+// Release moves the quarantined item id into the spool, due right away,
+// so the queue delivers it on its next scan.
+func (q *Queue) Release(id string) error {
+	path, err := q.quarantinePath(id)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errNotQuarantined
+	} else if err != nil {
+		return err
+	}
+	var item QueueItem
+	if err = json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+
+	item.NextAttempt = time.Now()
+	if err = writeItem(path, &item); err != nil {
+		return err
+	}
+	if err = os.Rename(path, filepath.Join(q.dir, id+".json")); err != nil {
+		return err
+	}
+
+	log.Println("released quarantined delivery to " + strings.Join(item.Recipients, ", "))
+	return nil
+}
+
+// Discard deletes the quarantined item id without delivering it.
+func (q *Queue) Discard(id string) error {
+	path, err := q.quarantinePath(id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		return errNotQuarantined
+	} else if err != nil {
+		return err
+	}
+
+	log.Println("deleted quarantined item " + id)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageScore(t *testing.T) {
+	for value, want := range map[string]float64{
+		"7.3":       7.3,
+		"7.3 / 5.0": 7.3,
+		"-1":        -1,
+	} {
+		score, ok := messageScore(mail.Header{"X-Spam-Score": {value}}, "X-Spam-Score")
+		if !ok || score != want {
+			t.Errorf("score of %q = %v, %v, want %v", value, score, ok, want)
+		}
+	}
+	for _, value := range []string{"", "high"} {
+		if score, ok := messageScore(mail.Header{"X-Spam-Score": {value}}, "X-Spam-Score"); ok {
+			t.Errorf("score of %q = %v, want none", value, score)
+		}
+	}
+}
+
+func TestQuarantineRelease(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	q, err := openQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipient := range []string{"held@example.org", "junk@example.org"} {
+		item := &QueueItem{
+			Sender:     "sender@example.com",
+			Recipients: []string{recipient},
+			Data:       []byte("X-Spam-Score: 9.1\r\nSubject: hi\r\n\r\nhi\r\n"),
+			Domain:     "example.org",
+			Route:      upstream.Addr(),
+			ReturnPath: "sender@example.com",
+			LastError:  "quarantined with X-Spam-Score 9.1, at or above 5",
+		}
+		if err = q.Quarantine(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// quarantined items aren't delivered
+	q.scan(nil)
+	if len(upstream.Messages()) != 0 || len(spooled(t, q.dir)) != 0 {
+		t.Fatal("quarantined message went out without a release")
+	}
+
+	call := func(handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		adminAuth("secret", handler)(response, request)
+		return response
+	}
+
+	var listed []QuarantinedItem
+	if err = json.NewDecoder(call(listQuarantine(q), "GET", "/quarantine").Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Recipients[0] != "held@example.org" || !strings.Contains(listed[0].Reason, "9.1") {
+		t.Fatalf("quarantine lists %+v, want both held messages", listed)
+	}
+
+	if response := call(settleQuarantine(q.Release), "POST", "/quarantine/release?id="+listed[0].Id); response.Code != http.StatusOK {
+		t.Fatalf("release answered %d: %s", response.Code, response.Body)
+	}
+	if response := call(settleQuarantine(q.Discard), "POST", "/quarantine/delete?id="+listed[1].Id); response.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", response.Code, response.Body)
+	}
+	for _, id := range []string{listed[1].Id, "../" + listed[0].Id, ""} {
+		if response := call(settleQuarantine(q.Release), "POST", "/quarantine/release?id="+id); response.Code != http.StatusNotFound {
+			t.Errorf("release of %q answered %d, want 404", id, response.Code)
+		}
+	}
+
+	q.scan(nil)
+	if messages := upstream.Messages(); len(messages) != 1 || !hasCommand(upstream.Commands(), "RCPT TO:<held@example.org>") {
+		t.Errorf("upstream got %d messages after the release, want the released one", len(messages))
+	}
+	if hasCommand(upstream.Commands(), "RCPT TO:<junk@example.org>") {
+		t.Error("deleted message was delivered")
+	}
+	if remaining, err := q.Quarantined(); err != nil || len(remaining) != 0 {
+		t.Errorf("quarantine still holds %+v, %v", remaining, err)
+	}
+}
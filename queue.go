@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var retryDelays = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 4 * time.Hour,
+}
+
+// QueueItem is one spooled delivery: the message as it would have gone to
+// the upstream, after VERP, DKIM and header rewriting.
+type QueueItem struct {
+	Sender      string
+	Recipients  []string
+	Data        []byte
+	Domain      string
+	Route       string
+	Tenant      string
+	ReturnPath  string
+	Size        int
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+
+	// RetryDelays overrides retryDelays for this item, from its alias or
+	// its destination domain's RetrySchedules entry.
+	RetryDelays []time.Duration
+}
+
+var retry_schedules map[string][]time.Duration
+
+// parseRetrySchedule parses a comma-separated list of retry delays in
+// seconds, such as "30,60,300".
+func parseRetrySchedule(spec string) ([]time.Duration, error) {
+	var delays []time.Duration
+	for _, part := range strings.Split(spec, ",") {
+		seconds, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("invalid retry schedule " + spec)
+		}
+		delays = append(delays, time.Duration(seconds)*time.Second)
+	}
+	return delays, nil
+}
+
+// retrySchedule picks the retry delays for a delivery through alias to
+// domain: the alias's own, then the domain's, else nil for the default.
+func retrySchedule(alias Alias, domain string) []time.Duration {
+	if len(alias.Retry) > 0 {
+		return alias.Retry
+	}
+	return retry_schedules[strings.ToLower(domain)]
+}
+
+// retryDelay is the wait before retry number attempt, repeating the last
+// delay of the schedule once it runs out.
+func (item *QueueItem) retryDelay(attempt int) time.Duration {
+	delays := retryDelays
+	if len(item.RetryDelays) > 0 {
+		delays = item.RetryDelays
+	}
+	if attempt < len(delays) {
+		return delays[attempt]
+	}
+	return delays[len(delays)-1]
+}
+
+// Queue spools deliveries that failed temporarily in QueueDir and retries
+// them with backoff. Items that fail permanently or run out of retries move
+// to the deferred subfolder; flagged messages wait in the quarantine
+// subfolder until released.
+type Queue struct {
+	dir        string
+	maxRetries int
+	bounces    *bounceLimiter
+}
+
+var queue_seq int64
+
+// openQueue creates the spool directories and checks they are writable, so
+// a misconfigured spool stops relayd at startup rather than losing mail.
+func openQueue(dir string, maxRetries int) (*Queue, error) {
+	q := &Queue{dir: dir, maxRetries: maxRetries}
+
+	for _, sub := range []string{q.deferredDir(), q.quarantineDir()} {
+		if err := os.MkdirAll(sub, 0750); err != nil {
+			return nil, err
+		}
+	}
+
+	probe := filepath.Join(dir, ".probe")
+	if err := ioutil.WriteFile(probe, nil, 0640); err != nil {
+		return nil, errors.New("queue directory " + dir + " is not writable: " + err.Error())
+	}
+	os.Remove(probe)
+
+	return q, nil
+}
+
+func (q *Queue) deferredDir() string {
+	return filepath.Join(q.dir, "deferred")
+}
+
+// Enqueue writes item to the spool, scheduling its first retry; a later
+// NextAttempt already set on item is kept.
+func (q *Queue) Enqueue(item *QueueItem) error {
+	item.Created = time.Now()
+	if next := item.Created.Add(item.retryDelay(0)); next.After(item.NextAttempt) {
+		item.NextAttempt = next
+	}
+
+	if err := writeItem(filepath.Join(q.dir, itemID(item.Created)+".json"), item); err != nil {
+		return err
+	}
+
+	log.Println("queued delivery to "+strings.Join(item.Recipients, ", ")+" after", item.LastError)
+	return nil
+}
+
+// itemID names an item created at created, unique within this process.
+func itemID(created time.Time) string {
+	return strconv.FormatInt(created.UnixNano(), 36) + "-" + strconv.FormatInt(atomic.AddInt64(&queue_seq, 1), 36)
+}
+
+func writeItem(path string, item *QueueItem) error {
+	return writeJSON(path, item)
+}
+
+// writeJSON replaces the file at path with v, so a crash leaves either the
+// old or the new content.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Run retries due items until stop is closed. It scans the spool right away,
+// so items left over from a previous run resume on startup. Closing stop lets
+// the attempt in progress finish and leaves the rest spooled for next time.
+func (q *Queue) Run(stop <-chan bool) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		q.scan(stop)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) scan(stop <-chan bool) {
+	q.bounces.Flush()
+
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		log.Println("failed to scan queue "+q.dir, err)
+		return
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(q.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println("failed to read queued item "+path, err)
+			continue
+		}
+
+		var item QueueItem
+		if err = json.Unmarshal(data, &item); err != nil {
+			log.Println("moving unreadable queued item "+path+" to deferred", err)
+			os.Rename(path, filepath.Join(q.deferredDir(), file.Name()))
+			continue
+		}
+
+		if item.NextAttempt.After(now) {
+			continue
+		}
+		q.attempt(path, &item)
+	}
+}
+
+func (q *Queue) attempt(path string, item *QueueItem) {
+	mailhosts := []string{item.Route}
+	var lookupErr error
+	if item.Route == "" {
+		var hosts []string
+		hosts, lookupErr = getMX(item.Domain)
+		mailhosts = nil
+		for _, host := range hosts {
+			mailhosts = append(mailhosts, host+":smtp")
+		}
+		if len(mailhosts) == 0 {
+			lookupErr = lookupFailure(item.Domain, lookupErr)
+		}
+	}
+
+	// every recipient gets its attempt; only the ones that failed
+	// temporarily stay spooled
+	var retry, failed []string
+	var retryErr, failedErr error
+	for _, recipient := range item.Recipients {
+		err := lookupErr
+		if err == nil {
+			trace := &deliveryTrace{}
+			started := time.Now()
+			err = deliverMX(item.Sender, recipient, item.Data, mailhosts, trace)
+			delivery_latency.Observe(time.Since(started).Seconds())
+			logDelivery(recipient, recipient, trace.Host, time.Since(started), err)
+			if trace.Tls != "" {
+				tls_outbound.Add(trace.Tls)
+			}
+			if err != nil {
+				deliveries_failed.WithLabelValues(failureClass(err)).Inc()
+			}
+		}
+
+		switch {
+		case err == nil:
+			messages_delivered.Inc()
+			usage.Record(item.Tenant, item.Size)
+		case temporaryError(err):
+			retry, retryErr = append(retry, recipient), err
+		default:
+			failed, failedErr = append(failed, recipient), err
+		}
+	}
+
+	item.Attempts++
+	if len(retry) > 0 && item.Attempts >= q.maxRetries {
+		failed, failedErr = append(failed, retry...), retryErr
+		retry = nil
+	}
+
+	name := filepath.Base(path)
+	if len(failed) > 0 {
+		if len(retry) > 0 {
+			// the rest of the item stays spooled under name
+			name = strings.TrimSuffix(name, ".json") + "-" + strconv.Itoa(item.Attempts) + ".json"
+		}
+		if werr := q.giveUp(name, *item, failed, failedErr); werr != nil {
+			log.Println("failed to move queued item to deferred", werr)
+			return
+		}
+	}
+
+	if len(retry) == 0 {
+		if len(failed) == 0 {
+			log.Println("delivered queued item "+name+" after attempt", item.Attempts)
+		}
+		os.Remove(path)
+		return
+	}
+
+	item.Recipients = retry
+	item.LastError = retryErr.Error()
+	delay := item.retryDelay(item.Attempts)
+	item.NextAttempt = time.Now().Add(delay)
+	log.Printf("queued delivery to %s failed, retrying in %v: %v", strings.Join(item.Recipients, ", "), delay, retryErr)
+
+	if werr := writeItem(path, item); werr != nil {
+		log.Println("failed to update queued item "+path, werr)
+	}
+}
+
+// giveUp bounces the delivery of item to recipients and keeps a record of
+// it as name in the deferred folder.
+func (q *Queue) giveUp(name string, item QueueItem, recipients []string, err error) error {
+	log.Printf("giving up on queued delivery to %s after %d attempts: %v", strings.Join(recipients, ", "), item.Attempts, err)
+	for _, recipient := range recipients {
+		sendBounce(q, item.ReturnPath, "", recipient, item.Data, err)
+	}
+
+	item.Recipients = recipients
+	item.LastError = err.Error()
+	return writeItem(filepath.Join(q.deferredDir(), name), &item)
+}
+
+// temporaryError reports whether a delivery failure is worth retrying, which
+// is anything but a 5xx reply from the upstream or relayd itself.
+func temporaryError(err error) bool {
+	switch e := err.(type) {
+	case *textproto.Error:
+		return e.Code < 500
+	case smtpd.Error:
+		return e.Code < 500
+	}
+	return err != errNullMX
+}
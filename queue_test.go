@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spooled returns the items waiting in dir, without the deferred ones.
+func spooled(t *testing.T, dir string) []QueueItem {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []QueueItem
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var item QueueItem
+		if err = json.Unmarshal(data, &item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestNullMXFailsPermanently(t *testing.T) {
+	fakeDNS(t, "nullmx.example. 300 IN MX 0 .")
+
+	if _, err := getMX("nullmx.example"); err != errNullMX {
+		t.Fatalf("getMX of a null MX domain: got %v, want errNullMX", err)
+	}
+	if temporaryError(errNullMX) {
+		t.Error("null MX treated as a temporary failure")
+	}
+
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(q.dir, "nullmx.json")
+	item := &QueueItem{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@nullmx.example"},
+		Data:       []byte("Subject: hi\r\n\r\nhi\r\n"),
+		Domain:     "nullmx.example",
+		ReturnPath: "sender@example.com",
+	}
+	if err = writeItem(path, item); err != nil {
+		t.Fatal(err)
+	}
+	q.attempt(path, item)
+
+	deferred := spooled(t, q.deferredDir())
+	if len(deferred) != 1 || deferred[0].Attempts != 1 || deferred[0].LastError != errNullMX.Error() {
+		t.Fatalf("deferred %+v, want the item given up on after its first attempt", deferred)
+	}
+	bounces := spooled(t, q.dir)
+	if len(bounces) != 1 || bounces[0].Recipients[0] != "sender@example.com" {
+		t.Errorf("spool holds %+v, want only a bounce to the sender", bounces)
+	}
+}
+
+func TestUnwritableSpool(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "spool")
+	if err := ioutil.WriteFile(blocker, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openQueue(blocker, 10); err == nil {
+		t.Error("openQueue on a path that can't be a directory succeeded, want relayd to refuse to start")
+	}
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	q, err := openQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spool disappears from under a running relayd
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	err = q.Enqueue(&QueueItem{Recipients: []string{"user@example.org"}, Domain: "example.org", LastError: "451 try later"})
+	if err == nil {
+		t.Fatal("Enqueue into an unwritable spool succeeded")
+	}
+	reply := deliveryReply(1, nil, true)
+	if smtpErr, ok := reply.(smtpd.Error); !ok || smtpErr.Code != 451 {
+		t.Errorf("sender got %v after the spool failed, want a 451", reply)
+	}
+}
+
+func TestPartialSpoolFailure(t *testing.T) {
+	// another destination took the message, but the one that couldn't be
+	// spooled would be lost without a retry from the client
+	if reply := deliveryReply(2, nil, true); reply == nil || reply.(smtpd.Error).Code != 451 {
+		t.Errorf("sender got %v with one destination delivered and one unspooled, want a 451", reply)
+	}
+
+	rejected := smtpd.Error{Code: 550, Message: "5.1.1 No such user"}
+	if reply := deliveryReply(2, []error{rejected}, true); reply == nil || reply.(smtpd.Error).Code != 451 {
+		t.Errorf("sender got %v with one destination rejected and one unspooled, want a 451", reply)
+	}
+	if reply := deliveryReply(2, []error{rejected}, false); reply != nil {
+		t.Errorf("sender got %v with one destination delivered and one rejected, want a 250", reply)
+	}
+	if reply := deliveryReply(1, []error{rejected}, false); reply != error(rejected) {
+		t.Errorf("sender got %v when the only destination rejected, want the rejection", reply)
+	}
+	if reply := deliveryReply(0, nil, false); reply != nil {
+		t.Errorf("sender got %v with nothing to deliver", reply)
+	}
+}
+
+func TestRetrySchedulePerDestination(t *testing.T) {
+	defer func(schedules map[string][]time.Duration) { retry_schedules = schedules }(retry_schedules)
+	retry_schedules = map[string][]time.Duration{"partner.example": {30 * time.Minute, time.Hour}}
+
+	aliases, err := parseAliasLines([]byte("ops@example.com ops@internal.example retry=5,10\nsales@example.com sales@partner.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an upstream that always defers
+	upstream := newFakeUpstream(t)
+	upstream.respond = func(line string) string {
+		if strings.HasPrefix(line, "RCPT") {
+			return "451 4.3.0 Try again later"
+		}
+		return ""
+	}
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		alias  Alias
+		domain string
+		delays []time.Duration
+	}{
+		{aliases[0], "internal.example", []time.Duration{5 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{aliases[1], "partner.example", []time.Duration{30 * time.Minute, time.Hour, time.Hour}},
+		{Alias{Source: "info@example.com"}, "other.example", retryDelays[:3]},
+	} {
+		item := &QueueItem{
+			Sender:      "sender@example.com",
+			Recipients:  []string{test.alias.Source},
+			Data:        []byte("Subject: hi\r\n\r\nhi\r\n"),
+			Domain:      test.domain,
+			Route:       upstream.Addr(),
+			RetryDelays: retrySchedule(test.alias, test.domain),
+		}
+		if err = q.Enqueue(item); err != nil {
+			t.Fatal(err)
+		}
+		if wait := item.NextAttempt.Sub(item.Created); wait != test.delays[0] {
+			t.Errorf("%s first retry in %v, want %v", test.domain, wait, test.delays[0])
+		}
+
+		path := filepath.Join(q.dir, "retry.json")
+		for _, delay := range test.delays[1:] {
+			before := time.Now()
+			q.attempt(path, item)
+			if wait := item.NextAttempt.Sub(before); wait < delay || wait > delay+time.Second {
+				t.Errorf("%s retry after attempt %d in %v, want %v", test.domain, item.Attempts, wait, delay)
+			}
+		}
+	}
+}
+
+func TestAttemptEveryRecipient(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	upstream.respond = func(line string) string {
+		switch line {
+		case "RCPT TO:<busy@example.org>":
+			return "451 4.2.1 Mailbox busy"
+		case "RCPT TO:<gone@example.org>":
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	}
+
+	q, err := openQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(q.dir, "item.json")
+	item := &QueueItem{
+		Sender:     "sender@example.com",
+		Recipients: []string{"first@example.org", "busy@example.org", "gone@example.org", "last@example.org"},
+		Data:       []byte("Subject: hi\r\n\r\nhi\r\n"),
+		Domain:     "example.org",
+		Route:      upstream.Addr(),
+		ReturnPath: "sender@example.com",
+	}
+	if err = writeItem(path, item); err != nil {
+		t.Fatal(err)
+	}
+
+	q.attempt(path, item)
+	for _, recipient := range []string{"first@example.org", "last@example.org"} {
+		if !hasCommand(upstream.Commands(), "RCPT TO:<"+recipient+">") {
+			t.Errorf("%s not attempted after earlier recipients failed", recipient)
+		}
+	}
+	if delivered := len(upstream.Messages()); delivered != 2 {
+		t.Errorf("upstream got %d messages, want the two accepted recipients", delivered)
+	}
+
+	var retrying, bounces []QueueItem
+	for _, queued := range spooled(t, q.dir) {
+		if queued.Recipients[0] == "sender@example.com" {
+			bounces = append(bounces, queued)
+		} else {
+			retrying = append(retrying, queued)
+		}
+	}
+	if len(retrying) != 1 || len(retrying[0].Recipients) != 1 || retrying[0].Recipients[0] != "busy@example.org" || retrying[0].Attempts != 1 {
+		t.Errorf("spool holds %+v for retry, want only busy@example.org", retrying)
+	}
+	if len(bounces) != 1 {
+		t.Errorf("spool holds %d bounces, want one for gone@example.org", len(bounces))
+	}
+	deferred := spooled(t, q.deferredDir())
+	if len(deferred) != 1 || len(deferred[0].Recipients) != 1 || deferred[0].Recipients[0] != "gone@example.org" {
+		t.Errorf("deferred holds %+v, want only gone@example.org", deferred)
+	}
+
+	// out of retries, the rest is given up too
+	q.attempt(path, &retrying[0])
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("item still spooled after its last retry: %v", err)
+	}
+	if deferred = spooled(t, q.deferredDir()); len(deferred) != 2 {
+		t.Errorf("deferred holds %+v, want both failed recipients recorded", deferred)
+	}
+}
+
+func TestMissingDomainFailsPermanently(t *testing.T) {
+	fakeDNS(t)
+
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(q.dir, "nxdomain.json")
+	item := &QueueItem{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@gone.example"},
+		Data:       []byte("Subject: hi\r\n\r\nhi\r\n"),
+		Domain:     "gone.example",
+		ReturnPath: "sender@example.com",
+	}
+	if err = writeItem(path, item); err != nil {
+		t.Fatal(err)
+	}
+	q.attempt(path, item)
+
+	deferred := spooled(t, q.deferredDir())
+	if len(deferred) != 1 || deferred[0].Attempts != 1 || !strings.Contains(deferred[0].LastError, "5.1.2") {
+		t.Fatalf("deferred %+v, want the item given up on after its first attempt", deferred)
+	}
+	bounces := spooled(t, q.dir)
+	if len(bounces) != 1 || bounces[0].Recipients[0] != "sender@example.com" {
+		t.Errorf("spool holds %+v, want only a bounce to the sender", bounces)
+	}
+}
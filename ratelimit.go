@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per source IP token bucket. Each IP may send burst
+// messages at once, refilled at rate per minute. Buckets that have refilled
+// completely are dropped every minute so the map only holds active senders.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	r := &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			r.collect(time.Now())
+		}
+	}()
+	return r
+}
+
+func (r *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+}
+
+// Allow takes a token for the IP of addr and reports whether one was left.
+func (r *rateLimiter) Allow(addr net.Addr) bool {
+	if r == nil {
+		return true
+	}
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	b, ok := r.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[ip] = b
+	}
+	r.refill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Penalize empties the token bucket of the IP of addr, so its next messages
+// are refused until it refills.
+func (r *rateLimiter) Penalize(addr net.Addr) {
+	if r == nil {
+		return
+	}
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.buckets[ip] = &tokenBucket{tokens: 0, last: time.Now()}
+}
+
+func (r *rateLimiter) collect(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for ip, b := range r.buckets {
+		r.refill(b, now)
+		if b.tokens >= r.burst {
+			delete(r.buckets, ip)
+		}
+	}
+}
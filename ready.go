@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// waitReady blocks until domain's MX resolves and every alias backend has a
+// table, refetching failed backends every two seconds. It gives up after
+// timeout so relayd never listens for mail it cannot route.
+func waitReady(aliases *AliasSet, domain string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		_, dnsErr := getMX(domain)
+
+		pending := len(aliases.Missing())
+
+		if dnsErr == nil && pending == 0 {
+			log.Println("dns and alias backends ready")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for dns and alias backends")
+		}
+
+		log.Printf("waiting for readiness: dns error %v, %d alias backends without a table", dnsErr, pending)
+		time.Sleep(2 * time.Second)
+
+		for _, backend := range aliases.Missing() {
+			aliases.RefreshBackend(backend)
+		}
+	}
+}
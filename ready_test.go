@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitReadyDefersUntilAliasesLoad(t *testing.T) {
+	fakeDNS(t, "ready.example. 300 IN MX 10 mx.ready.example.")
+	logged := captureLog(t)
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	backend := &AliasBackend{Url: path}
+	set := &AliasSet{Backends: []*AliasBackend{backend}}
+	set.RefreshBackend(backend)
+	if backend.Err == nil {
+		t.Fatal("missing alias file loaded")
+	}
+
+	written := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(time.Second)
+		ioutil.WriteFile(path, []byte("info@example.com ops@example.org\n"), 0640)
+		written <- time.Now()
+	}()
+
+	if err := waitReady(set, "ready.example", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-written:
+	default:
+		t.Fatal("waitReady returned before the alias table existed")
+	}
+	if len(backend.Aliases) != 1 {
+		t.Errorf("ready with aliases %v", backend.Aliases)
+	}
+	if !strings.Contains(logged.String(), "waiting for readiness: dns error <nil>, 1 alias backends without a table") {
+		t.Errorf("log %q lacks the waiting progress", logged.String())
+	}
+
+	// an unresolvable domain never becomes ready
+	if err := waitReady(set, "missing.example", time.Second); err == nil {
+		t.Error("waitReady succeeded without dns")
+	}
+}
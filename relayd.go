@@ -2,23 +2,34 @@ package main
 
 import (
 	"bitbucket.org/chrj/smtpd"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
 	"net"
 	"net/http"
 	"net/smtp"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 type Config struct {
@@ -30,11 +41,212 @@ type Config struct {
 	Tls  string
 	Time string
 	Url  string
+
+	HeaderlessPolicy string
+
+	Usage    string
+	UsageKey string
+
+	ClientTlsVersion string
+	ClientCiphers    string
+
+	Backends []string
+	Strategy string
+	Defer    string
+
+	BigRoute string
+	BigSize  string
+
+	SmartHost     string
+	SmartHostUser string
+	SmartHostPass string
+
+	Probe    string
+	ProbeNet string
+
+	Fingerprints []string
+
+	Utf8 string
+
+	ShutdownTimeout string
+	DrainTime       string
+	KillTime        string
+
+	DebugDns string
+
+	Verp string
+
+	SRSDomain string
+	SRSSecret string
+
+	RejectSPFFail string
+
+	Schedule []string
+	Timezone string
+
+	MaxAliases    string
+	MaxAliasBytes string
+
+	Dkim []DkimKey
+
+	DKIMKeyFile  string
+	DKIMSelector string
+	DKIMDomain   string
+
+	MaxReceived string
+	MaxHops     string
+
+	MaxHeaderSize string
+
+	MaxStale   string
+	StaleDefer string
+
+	SourcePorts string
+
+	DialTimeout string
+	Timeout     string
+
+	DateCheck string
+	DateSkew  string
+
+	MxRegion string
+	MxProbe  string
+
+	TlsFallback string
+
+	AdminBind  string
+	AdminToken string
+
+	Postmaster string
+	Domains    []string
+
+	Unsubscribe string
+
+	Pregreet       string
+	PregreetPolicy string
+	ProtocolPolicy string
+
+	Sentinel string
+
+	BlockPatterns []string
+	BlockCooldown string
+
+	SuffixMatch string
+
+	ClientAuth string
+	ClientCA   string
+
+	MaxAddress string
+
+	DnsConcurrency string
+
+	Dedupe string
+
+	WaitReady   string
+	ReadyDomain string
+
+	Alignment      string
+	TrustedDomains []string
+
+	TlsPolicy string
+
+	CertSource   string
+	ACMEEnabled  string
+	ACMEEmail    string
+	ACMEDomains  []string
+	ACMECacheDir string
+	ACMEHttpBind string
+
+	MaxChange     string
+	ChangeWebhook string
+
+	Groups string
+
+	IgnoreExtensions map[string][]string
+
+	OutboundTLS string
+
+	QueueDir       string
+	MaxRetries     string
+	RetrySchedules map[string]string
+
+	DeliveryDeadline string
+
+	// MinFreeSpace is the free space, in megabytes, below which new mail
+	// is deferred
+	MinFreeSpace string
+
+	// MaxBounces caps the bounces one return path gets per BounceWindow
+	// seconds; failures past it are held in QueueDir and go out together
+	// when the window ends
+	MaxBounces   string
+	BounceWindow string
+
+	// QuarantineScore holds messages whose ScoreHeader, added by a content
+	// scanner in front of relayd, reaches this score in QueueDir's
+	// quarantine folder for review instead of delivering them
+	QuarantineScore string
+	ScoreHeader     string
+
+	MaxConnectionsPerIP  string
+	MaxMessagesPerMinute string
+	MaxRecipients        string
+
+	FoldLocalPart       string
+	StripPlusAddressing string
+	StrictAliases       string
+
+	FallbackHost  string
+	FallbackAfter string
+	FallbackProbe string
+
+	HeloReject []string
+
+	MaxMessageSize string
+
+	MetricsBind string
+	HealthBind  string
+
+	AliasAuth string
+	AliasUser string
+	AliasPass string
+	AliasCA   string
+	AliasCert string
+	AliasKey  string
+
+	AliasFormat string
+
+	Resolvers []string
+
+	Listeners     []ListenerConfig
+	ProxyProtocol string
+
+	Submission      string
+	SubmissionUsers string
+
+	AllowedDestinationDomains []string
+
+	TLSMinVersion string
+	TLSCiphers    []string
+
+	LogFormat string
+	LogLevel  string
+	LogTarget string
+
+	MaxConcurrentDeliveries string
 }
 
 type Alias struct {
-	Source      string
-	Destination string
+	Source       string
+	Destinations []string
+	Tenant       string
+	List         bool
+	Expires      time.Time
+	Retry        []time.Duration
+
+	// Line is where the alias was defined: the line in the line format,
+	// the entry in JSON.
+	Line int
 }
 
 var config_file = flag.String("c", "/etc/relayd/relayd.conf", "config file")
@@ -45,294 +257,2384 @@ var bind_port = flag.Int("p", 25, "server port")
 var bind_interface = flag.String("i", "", "server interface")
 var hostname = flag.String("h", "localhost.localdomain", "server hostname")
 var refresh_time = flag.Int("r", 300, "refresh time in seconds")
-var alias_url = flag.String("u", "", "aliases fetch url")
+var alias_url = flag.String("u", "", "aliases fetch url or file")
 var show_help = flag.Bool("help", false, "show help")
 var show_version = flag.Bool("version", false, "print version")
+var dry_run = flag.Bool("dry-run", false, "check the aliases and their destinations' mx, then exit")
+var data_policy = flag.String("d", "reject", "empty or headerless message policy (reject, synthesize)")
+var probe_target = flag.String("probe", "1.2.3.4:80", "outbound ip probe target when no interface is given")
+var probe_net = flag.String("probe-net", "udp", "outbound ip probe protocol (udp, tcp)")
+var debug_dns = flag.Bool("debug-dns", false, "log mx lookup details")
+var mx_region = flag.String("mx-region", "", "prefer equal-preference mx hosts containing this string")
+var mx_probe = flag.Bool("mx-probe", false, "prefer equal-preference mx hosts with the lowest connect time")
+var tls_fallback = flag.Bool("tls-fallback", true, "retry outbound delivery in cleartext when starttls fails")
+var outbound_tls = flag.String("outbound-tls", "prefer", "outbound starttls policy (require, prefer, none)")
+var utf8_policy = flag.String("utf8", "reject", "policy for utf8 addresses to upstreams without SMTPUTF8 (reject, downgrade)")
+
+var usage *UsageStore
+
+var max_aliases = 0
+var max_alias_bytes int64 = 0
+var alias_sentinel = ""
+var suffix_match = false
+var fold_local = true
+var strip_plus = false
+var ignore_extensions map[string][]string
+
+var alias_format = ""
+var strict_aliases = false
+var dns_resolvers []string
+var alias_client = &http.Client{Timeout: 10 * time.Second}
+var alias_auth = ""
+var alias_user = ""
+var alias_pass = ""
 
 func init() {
 
 }
 
-func GetOutboundIP() string {
-	conn, err := net.Dial("udp", "1.2.3.4:80")
+// probe_target_v6 is tried when target is unreachable, for hosts with only
+// IPv6 connectivity. Like the default IPv4 target it needn't answer.
+var probe_target_v6 = "[2001:db8::1]:80"
+var outbound_min_tls uint16 = 0
+var smart_host = ""
+var smart_user = ""
+var smart_pass = ""
+
+// GetOutboundIP returns the local address the system would use to reach
+// target, falling back to an IPv6 target. With udp no packets are sent, the
+// dial only selects a route; tcp performs a real connection and needs the
+// target to accept it.
+func GetOutboundIP(network string, target string) (string, error) {
+	conn, err := net.Dial(network, target)
 	if err != nil {
-		log.Fatal(err)
+		var v6Err error
+		if conn, v6Err = net.Dial(network, probe_target_v6); v6Err != nil {
+			return "", err
+		}
 	}
 	defer conn.Close()
 
-	localAddr := conn.LocalAddr().String()
-	idx := strings.LastIndex(localAddr, ":")
-
-	return localAddr[0:idx]
-}
-
-func fetchEmailAliases(url string) ([]Alias, error) {
-	var httpClient = &http.Client{Timeout: 10 * time.Second}
-	var aliases []Alias
-
-	response, err := httpClient.Get(url)
-
-	if response != nil {
-		defer response.Body.Close()
-	}
-
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return host, nil
+}
 
-	if response.StatusCode != 200 {
-		return nil, errors.New("failed to fetch aliases")
+// bindAddress returns the address to listen on: bind from the config, else
+// the -i interface, and only without either the address found by probing
+// target.
+func bindAddress(bind string, iface string, network string, target string) (string, error) {
+	if bind != "" {
+		return bind, nil
 	}
+	if iface != "" {
+		return iface, nil
+	}
+	return GetOutboundIP(network, target)
+}
 
-	data, err := ioutil.ReadAll(response.Body)
+// parseAliasLines parses the line format: a source, whitespace, one or more
+// comma-separated destinations and optional flags.
+func parseAliasLines(data []byte) ([]Alias, error) {
+	var aliases []Alias
 	body := string(data)
 
 	lines := strings.Split(body, "\n")
 
-	for _, line := range lines {
+	if alias_sentinel != "" {
+		end := len(lines) - 1
+		for end >= 0 && strings.TrimSpace(lines[end]) == "" {
+			end--
+		}
+		if end < 0 || strings.TrimSpace(lines[end]) != alias_sentinel {
+			return nil, errors.New("alias table truncated, missing sentinel " + alias_sentinel)
+		}
+		lines = lines[:end]
+	}
+
+	for n, line := range lines {
 		ix := strings.IndexAny(line, " \t")
 		if ix > 0 {
 			source := strings.TrimSpace(line[:ix])
-			dest := strings.TrimSpace(line[ix+1:])
-			alias := Alias{source, dest}
+			fields := strings.Fields(line[ix+1:])
+			if len(fields) == 0 {
+				continue
+			}
+			var destinations []string
+			for _, destination := range strings.Split(fields[0], ",") {
+				if destination = strings.TrimSpace(destination); destination != "" {
+					destinations = append(destinations, destination)
+				}
+			}
+			if len(destinations) == 0 {
+				continue
+			}
+			alias := Alias{Source: source, Destinations: destinations, Line: n + 1}
+			for _, option := range fields[1:] {
+				switch {
+				case option == "list":
+					alias.List = true
+				case strings.HasPrefix(option, "tenant="):
+					alias.Tenant = option[len("tenant="):]
+				case strings.HasPrefix(option, "expires="):
+					alias.Expires = parseExpiry(option[len("expires="):])
+					if alias.Expires.IsZero() {
+						log.Println("ignoring invalid expiry for alias " + source + ": " + option)
+					}
+				case strings.HasPrefix(option, "retry="):
+					retry, err := parseRetrySchedule(option[len("retry="):])
+					if err != nil {
+						log.Println("ignoring invalid retry schedule for alias " + source + ": " + option)
+					}
+					alias.Retry = retry
+				default:
+					alias.Tenant = option
+				}
+			}
 			aliases = append(aliases, alias)
 		}
 	}
 
-	log.Printf("fetched %d aliases", len(aliases))
+	return aliases, nil
+}
 
-	return aliases, err
+type jsonAlias struct {
+	Source       string
+	Destination  string
+	Destinations []string
+	Tenant       string
+	List         bool
+	Expires      string
+	Retry        string
 }
 
-func getAlias(aliases []Alias, recipient string) (Alias, error) {
-	var err error
-	for _, alias := range aliases {
-		if alias.Source == recipient {
-			return alias, err
+// parseJSONAliases parses an array of objects with source, destination or
+// destinations, and the optional tenant, list and expires fields.
+func parseJSONAliases(data []byte) ([]Alias, error) {
+	var entries []jsonAlias
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	var aliases []Alias
+	for n, entry := range entries {
+		destinations := entry.Destinations
+		if entry.Destination != "" {
+			destinations = append([]string{entry.Destination}, destinations...)
+		}
+		if entry.Source == "" || len(destinations) == 0 {
+			log.Println("skipping json alias entry without source or destination")
+			continue
+		}
+
+		alias := Alias{Source: entry.Source, Destinations: destinations, Tenant: entry.Tenant, List: entry.List, Line: n + 1}
+		if entry.Expires != "" {
+			alias.Expires = parseExpiry(entry.Expires)
+			if alias.Expires.IsZero() {
+				log.Println("ignoring invalid expiry for alias " + entry.Source + ": " + entry.Expires)
+			}
+		}
+		if entry.Retry != "" {
+			retry, err := parseRetrySchedule(entry.Retry)
+			if err != nil {
+				log.Println("ignoring invalid retry schedule for alias " + entry.Source + ": " + entry.Retry)
+			}
+			alias.Retry = retry
 		}
+		aliases = append(aliases, alias)
 	}
-	return Alias{}, errors.New("recipient not found in alias table")
+	return aliases, nil
 }
 
-func getMX(domain_name string) string {
-	config, _ := dns.ClientConfigFromFile("/etc/resolv.conf")
-	c := new(dns.Client)
-	m := new(dns.Msg)
-	fqdn := domain_name + "."
-	m.SetQuestion(fqdn, dns.TypeMX)
-	m.RecursionDesired = true
-	r, _, err := c.Exchange(m, config.Servers[0]+":"+config.Port)
+// aliasFile reports whether source names a local file, either a path or a
+// file:// URL, and returns the path.
+func aliasFile(source string) (string, bool) {
+	if strings.HasPrefix(source, "file://") {
+		return source[len("file://"):], true
+	}
+	return source, !strings.Contains(source, "://")
+}
+
+func readAliasFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Println(err)
-		return ""
+		return nil, err
 	}
-	if r.Rcode != dns.RcodeSuccess {
-		log.Println("name lookup failed with code ", r.Rcode)
-		return ""
+	defer file.Close()
+
+	var reader io.Reader = file
+	if max_alias_bytes > 0 {
+		reader = io.LimitReader(file, max_alias_bytes+1)
 	}
 
-	for _, a := range r.Answer {
-		if mx, ok := a.(*dns.MX); ok {
-			str := mx.String()
-			ix := strings.LastIndexAny(str, " \t")
-			if ix > 0 && len(str) > 3 {
-				str = strings.TrimSpace(str[ix+1:])
-				return str[:len(str)-1]
-			}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if max_alias_bytes > 0 && int64(len(data)) > max_alias_bytes {
+		return nil, fmt.Errorf("alias table exceeds %d bytes", max_alias_bytes)
+	}
+	return data, nil
+}
+
+// newAliasClient builds the HTTP client for alias fetches, trusting the
+// PEM certificates in caFile in place of the system roots and presenting a
+// client certificate when one is given.
+func newAliasClient(caFile string, certFile string, keyFile string) (*http.Client, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
 		}
 	}
 
-	return ""
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}, nil
 }
 
-func main() {
-	var config Config
+func fetchAliasURL(url string) ([]byte, string, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if alias_auth != "" {
+		request.Header.Set("Authorization", alias_auth)
+	} else if alias_user != "" {
+		request.SetBasicAuth(alias_user, alias_pass)
+	}
 
-	flag.Parse()
+	response, err := alias_client.Do(request)
 
-	if *show_help != false {
-		flag.PrintDefaults()
-		os.Exit(0)
+	if response != nil {
+		defer response.Body.Close()
 	}
 
-	if *show_version != false {
-		fmt.Println("Relayd v0.1.0")
-		os.Exit(0)
+	if err != nil {
+		return nil, "", err
 	}
 
-	if *config_file != "" {
-		log.Println("loading", *config_file)
+	if response.StatusCode != 200 {
+		return nil, "", errors.New("failed to fetch aliases")
 	}
 
-	json_data, err := ioutil.ReadFile(*config_file)
-	json.Unmarshal(json_data, &config)
+	var reader io.Reader = response.Body
+	if max_alias_bytes > 0 {
+		reader = io.LimitReader(response.Body, max_alias_bytes+1)
+	}
 
+	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		return nil, "", err
 	}
-
-	if config.Host == "" {
-		config.Host = *hostname
+	if max_alias_bytes > 0 && int64(len(data)) > max_alias_bytes {
+		return nil, "", fmt.Errorf("alias table exceeds %d bytes", max_alias_bytes)
+	}
+	if response.ContentLength >= 0 && int64(len(data)) != response.ContentLength {
+		return nil, "", fmt.Errorf("alias table truncated, got %d of %d bytes", len(data), response.ContentLength)
 	}
+	return data, response.Header.Get("Content-Type"), nil
+}
 
-	if config.Bind == "" {
-		if *bind_interface == "" {
-			config.Bind = GetOutboundIP()
-		} else {
-			config.Bind = *bind_interface
+// fetchEmailAliases loads the alias table from an HTTP(S) URL or a local
+// file. The table is JSON when AliasFormat says so or, by default, when the
+// response is application/json or the file name ends in .json; otherwise it
+// is the line format.
+func fetchEmailAliases(url string) ([]Alias, error) {
+	var aliases []Alias
+	var data []byte
+	var err error
+
+	format := alias_format
+	if path, ok := aliasFile(url); ok {
+		data, err = readAliasFile(path)
+		if format == "" && strings.HasSuffix(path, ".json") {
+			format = "json"
 		}
+	} else {
+		var contentType string
+		data, contentType, err = fetchAliasURL(url)
+		if mediaType, _, _ := mime.ParseMediaType(contentType); format == "" && mediaType == "application/json" {
+			format = "json"
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if config.Port == "" {
-		config.Port = strconv.Itoa(*bind_port)
+	position := "line"
+	if format == "json" {
+		position = "entry"
+		aliases, err = parseJSONAliases(data)
+	} else {
+		aliases, err = parseAliasLines(data)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if *cert_file != "" {
-		config.Cert = *cert_file
+	if err = checkAliases(aliases, url, position); err != nil {
+		return nil, err
 	}
 
-	if *cert_key != "" {
-		config.Key = *cert_key
+	if max_aliases > 0 && len(aliases) > max_aliases {
+		return nil, fmt.Errorf("alias table has %d entries, limit is %d", len(aliases), max_aliases)
 	}
 
-	if config.Tls != "" {
-		if config.Tls == "false" {
-			*force_tls = false
-		} else if config.Tls == "true" {
-			*force_tls = true
+	log.Printf("fetched %d aliases", len(aliases))
+	alias_table_size.WithLabelValues(metricsSource(url)).Set(float64(len(aliases)))
+
+	return aliases, err
+}
+
+var errAliasExpired = errors.New("alias expired")
+
+// checkAliases warns about aliases whose source was already defined, which
+// getAlias never reaches, and aliases that forward to themselves. With
+// StrictAliases either fails the load.
+func checkAliases(aliases []Alias, url string, position string) error {
+	problems := 0
+	first := make(map[string]int)
+	for _, alias := range aliases {
+		key := normalizeAddress(alias.Source)
+		if line, ok := first[key]; ok {
+			log.Printf("%s %s %d: duplicate alias %s, first defined at %s %d", url, position, alias.Line, alias.Source, position, line)
+			problems++
+		} else {
+			first[key] = alias.Line
 		}
-	}
 
-	if config.Time != "" {
-		i, strerr := strconv.Atoi(config.Time)
-		if strerr == nil {
-			*refresh_time = i
+		for _, destination := range alias.Destinations {
+			if normalizeAddress(destination) == key {
+				log.Printf("%s %s %d: alias %s forwards to itself", url, position, alias.Line, alias.Source)
+				problems++
+			}
 		}
 	}
 
-	if config.Url != "" {
-		if *alias_url == "" {
-			*alias_url = config.Url
-		}
+	if problems > 0 && strict_aliases {
+		return fmt.Errorf("alias table has %d duplicate or self-referential entries", problems)
 	}
+	return nil
+}
 
-	if *alias_url == "" {
-		log.Fatal("need alias fetch url")
-		os.Exit(-3)
+// parseExpiry accepts an RFC 3339 timestamp or a date, which expires at the
+// start of that day in local time. It returns the zero time when invalid.
+func parseExpiry(value string) time.Time {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
 	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t
+	}
+	return time.Time{}
+}
 
-	log.Println("loading certificate", config.Cert, config.Key)
-	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+func (alias Alias) expired(now time.Time) bool {
+	return !alias.Expires.IsZero() && !now.Before(alias.Expires)
+}
 
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-4)
+// normalizeAddress lowercases the domain of addr and, unless disabled, the
+// local part, so table entries match regardless of case.
+func normalizeAddress(addr string) string {
+	ix := strings.LastIndex(addr, "@")
+	if ix < 0 {
+		if fold_local {
+			return strings.ToLower(addr)
+		}
+		return addr
+	}
+	local, domain := addr[:ix], strings.ToLower(addr[ix+1:])
+	if fold_local {
+		local = strings.ToLower(local)
 	}
+	return local + "@" + domain
+}
 
-	signal_chan := make(chan os.Signal, 1)
-	signal.Notify(signal_chan, syscall.SIGHUP)
+// stripPlus removes a "+tag" detail from the local part of addr.
+func stripPlus(addr string) string {
+	ix := strings.LastIndex(addr, "@")
+	if ix < 0 {
+		return addr
+	}
+	if plus := strings.Index(addr[:ix], "+"); plus > 0 {
+		return addr[:plus] + addr[ix:]
+	}
+	return addr
+}
 
-	aliases, err := fetchEmailAliases(*alias_url)
+// getAlias returns the alias for recipient, comparing normalized addresses.
+// After an exact miss it retries without a "+tag" detail when plus
+// addressing is stripped, then tries an "@domain" catch-all and, with suffix
+// matching, catch-alls for each parent domain, so the most specific one wins.
+// A global "@" entry is the last resort. Expired entries are skipped; if one
+// was hit and nothing else matched the error is errAliasExpired.
+func getAlias(aliases []Alias, recipient string) (Alias, error) {
+	var err error
+	now := time.Now()
+	miss := errors.New("recipient not found in alias table")
+
+	recipient = normalizeAddress(recipient)
+	candidates := []string{recipient}
+	if strip_plus {
+		if stripped := stripPlus(recipient); stripped != recipient {
+			candidates = append(candidates, stripped)
+		}
+	}
 
-	go func() {
-		for {
-			s := <-signal_chan
-			switch s {
-			case syscall.SIGHUP:
-				aliases, err = fetchEmailAliases(*alias_url)
+	for _, candidate := range candidates {
+		for _, alias := range aliases {
+			if normalizeAddress(alias.Source) == candidate {
+				if alias.expired(now) {
+					log.Println("alias " + alias.Source + " expired at " + alias.Expires.Format(time.RFC3339))
+					miss = errAliasExpired
+					continue
+				}
+				return alias, err
 			}
 		}
+	}
 
-	}()
+	ix := strings.LastIndex(recipient, "@")
+	if ix < 0 {
+		return Alias{}, miss
+	}
 
-	periodic := time.NewTicker(time.Duration(*refresh_time) * time.Second)
-	go func() {
-		for {
-			select {
-			case <-periodic.C:
-				syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	domain := recipient[ix+1:]
+	for domain != "" {
+		for _, alias := range aliases {
+			if normalizeAddress(alias.Source) == "@"+domain {
+				if alias.expired(now) {
+					log.Println("alias " + alias.Source + " expired at " + alias.Expires.Format(time.RFC3339))
+					miss = errAliasExpired
+					continue
+				}
+				return alias, err
 			}
 		}
-	}()
-
-	server := &smtpd.Server{
 
-		Hostname: config.Host,
+		dot := strings.Index(domain, ".")
+		if !suffix_match || dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
 
-		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
-			for _, recipient := range env.Recipients {
+	for _, alias := range aliases {
+		if alias.Source == "@" && !alias.expired(now) {
+			return alias, err
+		}
+	}
 
-				// get alias email source -> destination
-				alias, err := getAlias(aliases, recipient)
+	return Alias{}, miss
+}
 
-				if err == nil {
-					ix := strings.Index(alias.Destination, "@")
-					domain := alias.Destination[ix+1:]
-					servername := getMX(domain)
+func hasHeaders(data []byte) bool {
+	line := data
+	if ix := bytes.IndexByte(data, '\n'); ix >= 0 {
+		line = data[:ix]
+	}
+	line = bytes.TrimRight(line, "\r")
 
-					if servername != "" {
-						log.Println("received email for " + recipient + " and forwarding to " + alias.Destination + " via " + servername)
-						mailhost := servername + ":smtp"
-						smtpConn, connErr := net.Dial("tcp", mailhost)
+	ix := bytes.IndexByte(line, ':')
+	if ix <= 0 {
+		return false
+	}
+	for _, c := range line[:ix] {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
 
-						if connErr != nil {
-							log.Println("connect error for "+mailhost, connErr)
-							return connErr
-						}
+func checkMessageData(data []byte, sender string, host string) ([]byte, error) {
+	empty := len(bytes.TrimSpace(data)) == 0
+	if !empty && hasHeaders(data) {
+		return data, nil
+	}
 
-						client, smtpErr := smtp.NewClient(smtpConn, servername)
-						if smtpErr != nil {
-							log.Println("failed to create client for "+mailhost, smtpErr)
-							return smtpErr
+	if *data_policy != "synthesize" {
+		if empty {
+			return nil, smtpd.Error{Code: 550, Message: "5.6.0 Empty message data"}
+		}
+		return nil, smtpd.Error{Code: 550, Message: "5.6.0 Message has no headers"}
+	}
+
+	from := sender
+	if from == "" {
+		from = "MAILER-DAEMON@" + host
+	}
+
+	header := "From: <" + from + ">\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + strconv.FormatInt(time.Now().UnixNano(), 36) + "@" + host + ">\r\n" +
+		"\r\n"
+
+	log.Println("synthesizing headers for message from " + sender)
+
+	return append([]byte(header), data...), nil
+}
+
+// messageRoute returns the host every message of size bytes goes to: the
+// smart host, or bigRoute for messages above bigSize. It returns "" when the
+// message goes to each destination's MX.
+func messageRoute(size int, bigSize int, bigRoute string) string {
+	if smart_host != "" {
+		return smart_host
+	}
+	if bigSize > 0 && size > bigSize && bigRoute != "" {
+		return bigRoute
+	}
+	return ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// downgradeAddress converts the domain of addr to its ASCII form. A non-ASCII
+// local part cannot be downgraded.
+func downgradeAddress(addr string) (string, error) {
+	ix := strings.LastIndex(addr, "@")
+	if !isASCII(addr[:ix+1]) {
+		return "", smtpd.Error{Code: 550, Message: "5.6.7 Cannot downgrade non-ASCII local part of " + addr}
+	}
+
+	domain, err := idna.Lookup.ToASCII(addr[ix+1:])
+	if err != nil {
+		return "", smtpd.Error{Code: 550, Message: "5.6.7 Invalid domain in " + addr}
+	}
+
+	return addr[:ix+1] + domain, nil
+}
+
+// checkAddressLength enforces the RFC 5321 limit of 64 octets for the local
+// part and maxLength for the whole address.
+func checkAddressLength(addr string, maxLength int) error {
+	if len(addr) > maxLength {
+		return smtpd.Error{Code: 501, Message: "5.1.3 Address too long"}
+	}
+	if ix := strings.LastIndex(addr, "@"); ix > 64 {
+		return smtpd.Error{Code: 501, Message: "5.1.3 Local part too long"}
+	}
+	return nil
+}
+
+var errNullMX = errors.New("domain does not accept mail (null MX)")
+var errNoSuchDomain = errors.New("domain does not exist")
+var errNoMailHost = errors.New("domain has no MX or address records")
+
+// lookupFailure is the delivery failure for a destination at domain when
+// looking up its mail hosts gave err, or no host at all. DNS saying there is
+// no host is permanent; a lookup that didn't get an answer is temporary.
+func lookupFailure(domain string, err error) error {
+	switch err {
+	case errNullMX:
+		return err
+	case errNoSuchDomain, errNoMailHost:
+		return smtpd.Error{Code: 550, Message: "5.1.2 " + domain + ": " + err.Error()}
+	case nil:
+		return smtpd.Error{Code: 550, Message: "5.1.2 " + domain + ": no usable mail host"}
+	}
+	return smtpd.Error{Code: 451, Message: "4.4.3 Looking up mail hosts for " + domain + " failed: " + err.Error()}
+}
+
+// getMX returns the MX hosts of domain_name in preference order, from the
+// cache when it holds a live answer.
+func getMX(domain_name string) ([]string, error) {
+	if ascii, err := idna.Lookup.ToASCII(domain_name); err == nil {
+		domain_name = ascii
+	}
+
+	entry, ok := cachedMX(domain_name)
+	groups, err := entry.groups, entry.err
+	if !ok {
+		var ttl uint32
+		groups, ttl, err = lookupMX(domain_name)
+		if err == nil && len(groups) == 0 {
+			groups, ttl, err = implicitMX(domain_name)
+		}
+		if err == nil || err == errNullMX || err == errNoSuchDomain || err == errNoMailHost {
+			cacheMX(domain_name, groups, err, ttl)
+		}
+	} else if *debug_dns {
+		log.Printf("dns: %s MX from cache", domain_name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, group := range groups {
+		hosts = append(hosts, orderMX(group, *mx_region, *mx_probe)...)
+	}
+
+	if *debug_dns && len(hosts) > 0 {
+		log.Printf("dns: %s order %v", domain_name, hosts)
+	}
+	return hosts, nil
+}
+
+// queryDNS sends a query for name to the configured resolvers in turn. It
+// moves on to the next resolver when one is unreachable or can't answer, but
+// takes its word for it when the name doesn't exist.
+func queryDNS(name string, qtype uint16) (*dns.Msg, string, time.Duration, error) {
+	servers := dns_resolvers
+	if len(servers) == 0 {
+		if config, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil {
+			for _, server := range config.Servers {
+				servers = append(servers, net.JoinHostPort(server, config.Port))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, "", 0, errors.New("no dns resolvers configured")
+	}
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
+	resolver := ""
+	for _, resolver = range servers {
+		r, rtt, err = c.Exchange(m, resolver)
+		if err == nil && r.Rcode != dns.RcodeServerFailure && r.Rcode != dns.RcodeRefused {
+			break
+		}
+		if err != nil {
+			log.Println("dns query to "+resolver+" failed", err)
+		} else {
+			log.Println("dns query to "+resolver+" failed with code", dns.RcodeToString[r.Rcode])
+		}
+	}
+	if err != nil {
+		return nil, resolver, rtt, err
+	}
+	return r, resolver, rtt, nil
+}
+
+// lookupMX queries the MX records of domain_name, returning the hosts grouped
+// by preference, lowest first, and the smallest TTL in the answer.
+func lookupMX(domain_name string) ([][]string, uint32, error) {
+	r, resolver, rtt, err := queryDNS(domain_name, dns.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return nil, 0, errNoSuchDomain
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		log.Println("name lookup failed with code ", r.Rcode)
+		return nil, 0, errors.New("name lookup failed with code " + dns.RcodeToString[r.Rcode])
+	}
+
+	if *debug_dns {
+		log.Printf("dns: %s MX answered by %s in %v with %d records", domain_name, resolver, rtt, len(r.Answer))
+		for _, a := range r.Answer {
+			if mx, ok := a.(*dns.MX); ok {
+				log.Printf("dns: %s MX %d %s ttl=%d", domain_name, mx.Preference, mx.Mx, mx.Hdr.Ttl)
+			}
+		}
+	}
+
+	var ttl uint32
+	for i, a := range r.Answer {
+		if i == 0 || a.Header().Ttl < ttl {
+			ttl = a.Header().Ttl
+		}
+	}
+
+	for _, a := range r.Answer {
+		if mx, ok := a.(*dns.MX); ok && mx.Preference == 0 && mx.Mx == "." && len(r.Answer) == 1 {
+			log.Println(domain_name + " publishes a null MX")
+			return nil, ttl, errNullMX
+		}
+	}
+
+	var records []*dns.MX
+	for _, a := range r.Answer {
+		if mx, ok := a.(*dns.MX); ok && len(mx.Mx) > 1 {
+			records = append(records, mx)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Preference < records[j].Preference
+	})
+
+	var groups [][]string
+	for i := 0; i < len(records); {
+		j := i
+		var group []string
+		for j < len(records) && records[j].Preference == records[i].Preference {
+			group = append(group, strings.TrimSuffix(records[j].Mx, "."))
+			j++
+		}
+		groups = append(groups, group)
+		i = j
+	}
+
+	return groups, ttl, nil
+}
+
+// implicitMX treats domain_name, which has no MX records, as its own mail
+// host when it has an address, as RFC 5321 section 5.1 asks.
+func implicitMX(domain_name string) ([][]string, uint32, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, _, _, err := queryDNS(domain_name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if r.Rcode == dns.RcodeNameError {
+			return nil, 0, errNoSuchDomain
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, 0, errors.New("name lookup failed with code " + dns.RcodeToString[r.Rcode])
+		}
+		for _, a := range r.Answer {
+			switch a.(type) {
+			case *dns.A, *dns.AAAA:
+				return [][]string{{domain_name}}, a.Header().Ttl, nil
+			}
+		}
+	}
+	return nil, 0, errNoMailHost
+}
+
+func deliveryError(err error) error {
+	if _, ok := err.(*handshakeError); ok {
+		return smtpd.Error{Code: 451, Message: "4.7.5 TLS negotiation with upstream failed"}
+	}
+	return err
+}
+
+// deliveryReply is the reply to a transaction once every destination has
+// been tried. A temporary failure that couldn't be spooled defers the whole
+// message so it isn't lost; otherwise it only fails when no destination took
+// the message.
+func deliveryReply(attempted int, failures []error, spoolFailed bool) error {
+	if spoolFailed {
+		return smtpd.Error{Code: 451, Message: "4.3.0 Unable to queue message, try again later"}
+	}
+	if len(failures) > 0 && len(failures) == attempted {
+		return deliveryError(failures[len(failures)-1])
+	}
+	return nil
+}
+
+// runDeliveries calls deliver for each of n batches, at most concurrency at
+// a time. Batches not started when deadline passes go to spool instead, and
+// it returns how many did; a zero deadline never passes.
+func runDeliveries(n int, concurrency int, deadline time.Time, deliver func(i int), spool func(i int)) int {
+	var wg sync.WaitGroup
+	slots := make(chan bool, concurrency)
+	late := 0
+	for i := 0; i < n; i++ {
+		slots <- true
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			<-slots
+			spool(i)
+			late++
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			deliver(i)
+		}(i)
+	}
+	wg.Wait()
+	return late
+}
+
+// forwardSet remembers the forwards of one message, so overlapping aliases
+// that resolve to the same destination send it once.
+type forwardSet map[[sha256.Size]byte]bool
+
+// First reports whether this is the first forward of body from sender to
+// destination.
+func (f forwardSet) First(sender string, destination string, body []byte) bool {
+	sum := sha256.Sum256([]byte(sender + "\x00" + destination + "\x00" + string(body)))
+	if f[sum] {
+		return false
+	}
+	f[sum] = true
+	return true
+}
+
+// hasExtension reports whether the upstream advertised ext, treating it as
+// absent when IgnoreExtensions lists it for the MX host or the destination
+// domain.
+func hasExtension(client *smtp.Client, ext string, servername string, destination string) bool {
+	domain := destination[strings.LastIndex(destination, "@")+1:]
+	for _, key := range []string{servername, domain} {
+		for _, ignored := range ignore_extensions[strings.ToLower(key)] {
+			if strings.EqualFold(ignored, ext) {
+				return false
+			}
+		}
+	}
+
+	ok, _ := client.Extension(ext)
+	return ok
+}
+
+type deliveryTrace struct {
+	Host string
+	Tls  string
+}
+
+// deliverMessage sends body to destinations via mailhost in one session,
+// filling in trace when it is non-nil. It returns an error per destination.
+func deliverMessage(sender string, destinations []string, body []byte, mailhost string, trace *deliveryTrace) []error {
+	errs := sendMessage(sender, destinations, body, mailhost, true, trace)
+
+	if tlsErr, ok := errs[0].(*handshakeError); ok && *tls_fallback && *outbound_tls != "require" {
+		log.Println("delivering to "+mailhost+" in cleartext after tls failure:", tlsErr.diagnosis)
+		return sendMessage(sender, destinations, body, mailhost, false, trace)
+	}
+
+	return errs
+}
+
+// sendMessage issues one RCPT per destination and sends body once to those
+// accepted. An error before RCPT or after DATA applies to every destination
+// that doesn't already have one.
+func sendMessage(sender string, destinations []string, body []byte, mailhost string, starttls bool, trace *deliveryTrace) []error {
+	errs := make([]error, len(destinations))
+	if err := sendSession(sender, destinations, body, mailhost, starttls, trace, errs); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func sendSession(sender string, destinations []string, body []byte, mailhost string, starttls bool, trace *deliveryTrace, errs []error) error {
+	servername, _, err := net.SplitHostPort(mailhost)
+	if err != nil {
+		return err
+	}
+
+	if trace != nil {
+		trace.Host = mailhost
+	}
+
+	smtpConn, connErr := dialOutbound(mailhost)
+
+	if connErr != nil {
+		log.Println("connect error for "+mailhost, connErr)
+		return &connectError{connErr}
+	}
+
+	// every command gets command_timeout from when it is sent
+	deadline := func() {
+		smtpConn.SetDeadline(time.Now().Add(command_timeout))
+	}
+
+	deadline()
+	client, smtpErr := smtp.NewClient(smtpConn, servername)
+	if smtpErr != nil {
+		log.Println("failed to create client for "+mailhost, smtpErr)
+		smtpConn.Close()
+		return &connectError{smtpErr}
+	}
+	defer func() {
+		deadline()
+		client.Quit()
+	}()
+
+	deadline()
+	if err = client.Hello(*hostname); err != nil {
+		log.Println("ehlo error for "+mailhost, err)
+		return err
+	}
+
+	if trace != nil {
+		trace.Tls = "none"
+	}
+
+	// a batch shares one destination domain
+	destination := destinations[0]
+
+	if starttls && *outbound_tls != "none" {
+		if hasExtension(client, "STARTTLS", servername, destination) {
+			deadline()
+			err = client.StartTLS(&tls.Config{ServerName: servername, MinVersion: outbound_min_tls})
+			if err != nil {
+				tlsErr := &handshakeError{err, diagnoseTLS(err)}
+				log.Println("starttls error for "+mailhost, tlsErr)
+				client.Close()
+				return tlsErr
+			}
+			if state, ok := client.TLSConnectionState(); ok && trace != nil {
+				trace.Tls = tls.VersionName(state.Version)
+			}
+		} else if *outbound_tls == "require" {
+			log.Println(mailhost + " does not offer STARTTLS, refusing cleartext delivery to " + strings.Join(destinations, ", "))
+			return errNoStartTLS
+		}
+	}
+
+	if mailhost == smart_host && smart_user != "" {
+		// PlainAuth refuses to send credentials without TLS
+		deadline()
+		if err = client.Auth(smtp.PlainAuth("", smart_user, smart_pass, servername)); err != nil {
+			log.Println("auth error for "+mailhost, err)
+			return err
+		}
+	}
+
+	utf8 := hasExtension(client, "SMTPUTF8", servername, destination)
+	if !isASCII(sender) && !utf8 {
+		if *utf8_policy != "downgrade" {
+			log.Println(mailhost + " does not support SMTPUTF8 for " + sender)
+			return smtpd.Error{Code: 550, Message: "5.6.7 Upstream does not support SMTPUTF8"}
+		}
+		if sender, err = downgradeAddress(sender); err != nil {
+			return err
+		}
+	}
+
+	deadline()
+	err = client.Mail(sender)
+	if err != nil {
+		log.Println("mail-from error", err)
+		return err
+	}
+
+	accepted := 0
+	for i, destination := range destinations {
+		if !isASCII(destination) && !utf8 {
+			if *utf8_policy != "downgrade" {
+				log.Println(mailhost + " does not support SMTPUTF8 for " + destination)
+				errs[i] = smtpd.Error{Code: 550, Message: "5.6.7 Upstream does not support SMTPUTF8"}
+				continue
+			}
+			if destination, err = downgradeAddress(destination); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		deadline()
+		if err = client.Rcpt(destination); err != nil {
+			log.Println("rcpt-to error for "+destination, err)
+			errs[i] = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return nil
+	}
+
+	deadline()
+	data, writeErr := client.Data()
+	if writeErr != nil {
+		log.Println("data error", writeErr)
+		return writeErr
+	}
+
+	deadline()
+	_, writeErr = data.Write(body)
+
+	if writeErr != nil {
+		data.Close()
+		log.Println("failed to write data to "+mailhost, writeErr)
+		return writeErr
+	}
+
+	deadline()
+	return data.Close()
+}
+
+func main() {
+	flag.Parse()
+
+	if *show_help != false {
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if *show_version != false {
+		fmt.Println("Relayd v0.1.0")
+		os.Exit(0)
+	}
+
+	if *config_file != "" {
+		log.Println("loading", *config_file)
+	}
+
+	config, err := loadConfig(*config_file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if err = setupLogging(config.LogFormat, config.LogLevel, config.LogTarget); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	// running is the config as read, before defaults and flags are applied,
+	// for comparing against on reload
+	running := config
+	url_flag := *alias_url
+
+	if config.Host == "" {
+		config.Host = *hostname
+	}
+	*hostname = config.Host
+
+	if config.Probe != "" {
+		*probe_target = config.Probe
+	}
+
+	if config.ProbeNet != "" {
+		*probe_net = config.ProbeNet
+	}
+
+	config.Bind, err = bindAddress(config.Bind, *bind_interface, *probe_net, *probe_target)
+	if err != nil {
+		log.Println("cannot detect outbound address, listening on all interfaces:", err)
+	}
+
+	if config.Port == "" {
+		config.Port = strconv.Itoa(*bind_port)
+	}
+
+	if *cert_file != "" {
+		config.Cert = *cert_file
+	}
+
+	if *cert_key != "" {
+		config.Key = *cert_key
+	}
+
+	// ACMEEnabled is shorthand for CertSource acme for our own hostname
+	if config.ACMEEnabled == "true" {
+		if config.CertSource == "" {
+			config.CertSource = "acme"
+		}
+		if len(config.ACMEDomains) == 0 {
+			config.ACMEDomains = []string{config.Host}
+		}
+	}
+
+	if config.Tls != "" {
+		if config.Tls == "false" {
+			*force_tls = false
+		} else if config.Tls == "true" {
+			*force_tls = true
+		}
+	}
+
+	if config.Time != "" {
+		i, strerr := strconv.Atoi(config.Time)
+		if strerr == nil {
+			*refresh_time = i
+		}
+	}
+
+	if config.HeaderlessPolicy == "" {
+		config.HeaderlessPolicy = *data_policy
+	}
+	*data_policy = config.HeaderlessPolicy
+
+	if config.DebugDns == "true" {
+		*debug_dns = true
+	}
+
+	if config.MxRegion != "" {
+		*mx_region = config.MxRegion
+	}
+
+	if config.MxProbe == "true" {
+		*mx_probe = true
+	}
+
+	if config.TlsFallback == "false" {
+		*tls_fallback = false
+	}
+
+	if config.Utf8 != "" {
+		*utf8_policy = config.Utf8
+	}
+
+	if config.OutboundTLS != "" {
+		*outbound_tls = config.OutboundTLS
+	}
+	switch *outbound_tls {
+	case "require", "prefer", "none":
+	default:
+		log.Fatal("invalid outbound tls policy " + *outbound_tls)
+	}
+
+	for _, policy := range config.HeloReject {
+		switch policy {
+		case "literal", "localhost", "unresolvable":
+		default:
+			log.Fatal("invalid helo reject policy " + policy)
+		}
+	}
+
+	if config.Url != "" {
+		if *alias_url == "" {
+			*alias_url = config.Url
+		}
+	}
+
+	if config.DialTimeout != "" {
+		if i, strerr := strconv.Atoi(config.DialTimeout); strerr == nil && i > 0 {
+			dial_timeout = time.Duration(i) * time.Second
+		}
+	}
+	if config.Timeout != "" {
+		if i, strerr := strconv.Atoi(config.Timeout); strerr == nil && i > 0 {
+			command_timeout = time.Duration(i) * time.Second
+		}
+	}
+
+	if config.SourcePorts != "" {
+		source_port_min, source_port_max, err = parsePortRange(config.SourcePorts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-7)
+		}
+	}
+
+	dedupe := config.Dedupe != "false"
+
+	dns_concurrency := 4
+	if config.DnsConcurrency != "" {
+		if i, strerr := strconv.Atoi(config.DnsConcurrency); strerr == nil {
+			dns_concurrency = i
+		}
+	}
+
+	max_deliveries := 4
+	if config.MaxConcurrentDeliveries != "" {
+		if i, strerr := strconv.Atoi(config.MaxConcurrentDeliveries); strerr == nil && i > 0 {
+			max_deliveries = i
+		}
+	}
+
+	var delivery_deadline time.Duration
+	if config.DeliveryDeadline != "" {
+		if i, strerr := strconv.Atoi(config.DeliveryDeadline); strerr == nil && i > 0 {
+			delivery_deadline = time.Duration(i) * time.Second
+		}
+	}
+
+	max_address := 254
+	if config.MaxAddress != "" {
+		if i, strerr := strconv.Atoi(config.MaxAddress); strerr == nil {
+			max_address = i
+		}
+	}
+
+	max_header_size := 0
+	if config.MaxHeaderSize != "" {
+		if i, strerr := strconv.Atoi(config.MaxHeaderSize); strerr == nil {
+			max_header_size = i
+		}
+	}
+
+	date_skew := 7 * 24 * time.Hour
+	if config.DateSkew != "" {
+		if i, strerr := strconv.Atoi(config.DateSkew); strerr == nil {
+			date_skew = time.Duration(i) * time.Second
+		}
+	}
+
+	// MaxReceived is the older name for MaxHops
+	max_hops := 25
+	if config.MaxHops == "" {
+		config.MaxHops = config.MaxReceived
+	}
+	if config.MaxHops != "" {
+		if i, strerr := strconv.Atoi(config.MaxHops); strerr == nil {
+			max_hops = i
+		}
+	}
+
+	block_cooldown := time.Hour
+	if config.BlockCooldown != "" {
+		if i, strerr := strconv.Atoi(config.BlockCooldown); strerr == nil {
+			block_cooldown = time.Duration(i) * time.Second
+		}
+	}
+	reputation := newReputationGuard(config.BlockPatterns, block_cooldown)
+
+	var fallback *fallbackRouter
+	if config.FallbackHost != "" {
+		fallback_after := 3
+		if config.FallbackAfter != "" {
+			if i, strerr := strconv.Atoi(config.FallbackAfter); strerr == nil && i > 0 {
+				fallback_after = i
+			}
+		}
+		fallback_probe := 10 * time.Minute
+		if config.FallbackProbe != "" {
+			if i, strerr := strconv.Atoi(config.FallbackProbe); strerr == nil {
+				fallback_probe = time.Duration(i) * time.Second
+			}
+		}
+		fallback = newFallbackRouter(config.FallbackHost, fallback_after, fallback_probe)
+	}
+
+	var srs *srsRewriter
+	if config.SRSDomain != "" {
+		srs = newSRSRewriter(config.SRSDomain, config.SRSSecret)
+	}
+
+	var schedule []Window
+	for _, spec := range config.Schedule {
+		window, schedErr := parseWindow(spec)
+		if schedErr != nil {
+			fmt.Println(schedErr)
+			os.Exit(-7)
+		}
+		schedule = append(schedule, window)
+	}
+
+	location := time.Local
+	if config.Timezone != "" {
+		location, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-7)
+		}
+	}
+
+	// zero means no limit; smtpd would otherwise apply its own 10 MB default
+	max_message_size := 0
+	if config.MaxMessageSize != "" {
+		if i, strerr := strconv.Atoi(config.MaxMessageSize); strerr == nil && i >= 0 {
+			max_message_size = i
+		}
+	}
+	smtpd_message_size := max_message_size
+	if smtpd_message_size == 0 {
+		smtpd_message_size = math.MaxInt32
+	}
+
+	// zero leaves smtpd's own default of 100 in place
+	max_recipients := 0
+	if config.MaxRecipients != "" {
+		if i, strerr := strconv.Atoi(config.MaxRecipients); strerr == nil && i > 0 {
+			max_recipients = i
+		}
+	}
+
+	var limiter *rateLimiter
+	if config.MaxMessagesPerMinute != "" {
+		if i, strerr := strconv.Atoi(config.MaxMessagesPerMinute); strerr == nil && i > 0 {
+			limiter = newRateLimiter(i)
+		}
+	}
+
+	big_size := 0
+	if config.BigSize != "" {
+		i, strerr := strconv.Atoi(config.BigSize)
+		if strerr == nil {
+			big_size = i
+		}
+	}
+
+	if *alias_url == "" && len(config.Backends) == 0 {
+		log.Fatal("need alias fetch url")
+		os.Exit(-3)
+	}
+
+	alias_sources := config.Backends
+	if len(alias_sources) == 0 {
+		alias_sources = []string{*alias_url}
+	}
+
+	if config.MaxAliases != "" {
+		if i, strerr := strconv.Atoi(config.MaxAliases); strerr == nil {
+			max_aliases = i
+		}
+	}
+
+	if config.MaxAliasBytes != "" {
+		if i, strerr := strconv.ParseInt(config.MaxAliasBytes, 10, 64); strerr == nil {
+			max_alias_bytes = i
+		}
+	}
+
+	alias_sentinel = config.Sentinel
+
+	for _, resolver := range config.Resolvers {
+		if _, _, splitErr := net.SplitHostPort(resolver); splitErr != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		dns_resolvers = append(dns_resolvers, resolver)
+	}
+
+	switch config.AliasFormat {
+	case "", "json", "text":
+		alias_format = config.AliasFormat
+	default:
+		log.Fatal("invalid alias format " + config.AliasFormat)
+	}
+
+	smart_host = config.SmartHost
+	smart_user, smart_pass = config.SmartHostUser, config.SmartHostPass
+
+	alias_auth = config.AliasAuth
+	alias_user, alias_pass = config.AliasUser, config.AliasPass
+	if config.AliasCA != "" || config.AliasCert != "" {
+		alias_client, err = newAliasClient(config.AliasCA, config.AliasCert, config.AliasKey)
+		if err != nil {
+			fmt.Println("failed to set up alias fetch tls:", err)
+			os.Exit(-10)
+		}
+	}
+
+	ignore_extensions = make(map[string][]string)
+	for key, exts := range config.IgnoreExtensions {
+		ignore_extensions[strings.ToLower(key)] = exts
+	}
+	suffix_match = config.SuffixMatch == "true"
+	fold_local = config.FoldLocalPart != "false"
+	strip_plus = config.StripPlusAddressing == "true"
+	strict_aliases = config.StrictAliases == "true"
+
+	if *dry_run {
+		os.Exit(dryRun(os.Stdout, alias_sources, dns_concurrency))
+	}
+
+	if problems := validateConfig(config, alias_sources, *refresh_time); len(problems) > 0 {
+		fmt.Println("invalid configuration:")
+		for _, problem := range problems {
+			fmt.Println("  " + problem.Error())
+		}
+		os.Exit(-2)
+	}
+
+	if config.Usage != "" {
+		usage, err = loadUsage(config.Usage)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-5)
+		}
+	}
+
+	var queue *Queue
+	var disk *diskWatermark
+	if config.QueueDir != "" {
+		max_retries := 10
+		if config.MaxRetries != "" {
+			if i, strerr := strconv.Atoi(config.MaxRetries); strerr == nil {
+				max_retries = i
+			}
+		}
+
+		queue, err = openQueue(config.QueueDir, max_retries)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-9)
+		}
+
+		if config.MinFreeSpace != "" {
+			if i, strerr := strconv.Atoi(config.MinFreeSpace); strerr == nil && i > 0 {
+				disk = newDiskWatermark(config.QueueDir, uint64(i)<<20)
+				go disk.Run(30 * time.Second)
+			}
+		}
+
+		retry_schedules = make(map[string][]time.Duration)
+		for domain, spec := range config.RetrySchedules {
+			retry_schedules[strings.ToLower(domain)], err = parseRetrySchedule(spec)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-9)
+			}
+		}
+	}
+
+	if config.MaxBounces != "" && queue != nil {
+		if i, strerr := strconv.Atoi(config.MaxBounces); strerr == nil && i > 0 {
+			bounce_window := 3600
+			if config.BounceWindow != "" {
+				if j, strerr := strconv.Atoi(config.BounceWindow); strerr == nil && j > 0 {
+					bounce_window = j
+				}
+			}
+			queue.bounces, err = newBounceLimiter(queue, time.Duration(bounce_window)*time.Second, i)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-9)
+			}
+		}
+	}
+
+	quarantine_score := 0.0
+	score_header := "X-Spam-Score"
+	if config.QuarantineScore != "" && queue != nil {
+		if f, strerr := strconv.ParseFloat(config.QuarantineScore, 64); strerr == nil {
+			quarantine_score = f
+		}
+		if config.ScoreHeader != "" {
+			score_header = config.ScoreHeader
+		}
+	}
+
+	var client_tls_version uint16
+	if config.ClientTlsVersion != "" {
+		client_tls_version, err = parseTLSVersion(config.ClientTlsVersion)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-6)
+		}
+	}
+
+	// DKIMKeyFile signs everything no per-domain key covers
+	if config.DKIMKeyFile != "" {
+		if config.DKIMDomain == "" {
+			config.DKIMDomain = config.Host
+		}
+		config.Dkim = append(config.Dkim, DkimKey{Domain: config.DKIMDomain, Selector: config.DKIMSelector, KeyFile: config.DKIMKeyFile, fallback: true})
+	}
+	if err = loadDkimKeys(config.Dkim); err != nil {
+		fmt.Println(err)
+		os.Exit(-8)
+	}
+
+	var certs CertSource
+	switch config.CertSource {
+	case "", "file":
+		certs, err = newFileCertSource(config.Cert, config.Key)
+	case "acme":
+		certs, err = newAcmeCertSource(config.ACMEDomains, config.ACMEEmail, config.ACMECacheDir, config.ACMEHttpBind)
+	default:
+		err = errors.New("invalid certificate source " + config.CertSource)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-4)
+	}
+
+	signal_chan := make(chan os.Signal, 1)
+	signal.Notify(signal_chan, syscall.SIGHUP)
+
+	aliases := &AliasSet{
+		Strategy:   config.Strategy,
+		Defer:      config.Defer != "false",
+		StaleDefer: config.StaleDefer == "true",
+		Postmaster: config.Postmaster,
+		Domains:    append([]string{config.Host}, config.Domains...),
+		Webhook:    config.ChangeWebhook,
+		RetryMax:   time.Duration(*refresh_time) * time.Second,
+	}
+	if config.MaxChange != "" {
+		if f, strerr := strconv.ParseFloat(config.MaxChange, 64); strerr == nil {
+			aliases.MaxChange = f
+		}
+	}
+	if aliases.Postmaster == "" {
+		log.Println("no Postmaster set, postmaster@ mail needs an alias")
+	}
+	if config.MaxStale != "" {
+		if i, strerr := strconv.Atoi(config.MaxStale); strerr == nil {
+			aliases.MaxStale = time.Duration(i) * time.Second
+		}
+	}
+	for _, url := range alias_sources {
+		aliases.Backends = append(aliases.Backends, &AliasBackend{Url: url})
+	}
+
+	aliases.Refresh()
+
+	// tables older than three refresh intervals mean refreshes keep failing
+	health := healthz(aliases, 3*time.Duration(*refresh_time)*time.Second, disk)
+	if config.MetricsBind != "" {
+		startMetrics(config.MetricsBind).HandleFunc("/healthz", health)
+	}
+	if config.HealthBind != "" && config.HealthBind != config.MetricsBind {
+		startHealth(config.HealthBind, health)
+	}
+
+	if config.AdminBind != "" {
+		if config.AdminToken == "" {
+			log.Fatal("need AdminToken to enable the admin listener")
+		}
+		startAdmin(config.AdminBind, config.AdminToken, config.Host, aliases, queue)
+	}
+
+	if config.WaitReady != "" {
+		if i, strerr := strconv.Atoi(config.WaitReady); strerr == nil && i > 0 {
+			domain := config.ReadyDomain
+			if domain == "" {
+				domain = config.Host
+			}
+			if err = waitReady(aliases, domain, time.Duration(i)*time.Second); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	periodic := time.NewTicker(time.Duration(*refresh_time) * time.Second)
+
+	// SIGHUP rereads the config file, applies the certificate, refresh
+	// interval and alias sources, and refetches the aliases
+	reload := func() {
+		reloaded, loadErr := loadConfig(*config_file)
+		if loadErr != nil {
+			log.Println("keeping current config:", loadErr)
+			return
+		}
+		log.Println("reloaded", *config_file)
+
+		if fields := restartFields(running, reloaded); len(fields) > 0 {
+			log.Println("restart relayd to apply changes to " + strings.Join(fields, ", "))
+		}
+
+		if file, ok := certs.(*fileCertSource); ok {
+			cert, key := reloaded.Cert, reloaded.Key
+			if *cert_file != "" {
+				cert = *cert_file
+			}
+			if *cert_key != "" {
+				key = *cert_key
+			}
+			if certErr := file.Reload(cert, key); certErr != nil {
+				log.Println("keeping current certificate:", certErr)
+			}
+		}
+
+		if reloaded.Time != running.Time {
+			if i, strerr := strconv.Atoi(reloaded.Time); strerr == nil && i > 0 {
+				log.Printf("alias refresh interval now %ds", i)
+				*refresh_time = i
+				periodic.Reset(time.Duration(i) * time.Second)
+			}
+		}
+
+		sources := reloaded.Backends
+		if len(sources) == 0 {
+			url := url_flag
+			if url == "" {
+				url = reloaded.Url
+			}
+			if url != "" {
+				sources = []string{url}
+			}
+		}
+		if len(sources) == 0 {
+			log.Println("reloaded config has no alias sources, keeping the current ones")
+		} else {
+			aliases.Reconfigure(sources, time.Duration(*refresh_time)*time.Second)
+		}
+
+		running.Cert, running.Key, running.Time = reloaded.Cert, reloaded.Key, reloaded.Time
+		running.Url, running.Backends = reloaded.Url, reloaded.Backends
+	}
+
+	go func() {
+		for {
+			select {
+			case s := <-signal_chan:
+				switch s {
+				case syscall.SIGHUP:
+					reload()
+					aliases.Refresh()
+				}
+			case <-periodic.C:
+				aliases.Refresh()
+			}
+		}
+	}()
+
+	var tracker *connTracker
+	var listeners *multiListener
+
+	guard := newProtocolGuard(config.ProtocolPolicy, limiter)
+
+	// the checkers behind the protocol guard
+	checkSender := func(peer smtpd.Peer, addr string) error {
+		if err := checkCleartext(listeners, tracker, config.TlsPolicy, peer); err != nil {
+			return err
+		}
+		if !limiter.Allow(peer.Addr) {
+			log.Println("rate limiting messages from", peer.Addr)
+			return smtpd.Error{Code: 450, Message: "4.7.1 Too many messages, slow down"}
+		}
+		if err := checkAddressLength(addr, max_address); err != nil {
+			return err
+		}
+		if ip := peerIP(peer.Addr); ip != nil && peer.Username == "" {
+			result := checkSPF(ip, addr, peer.HeloName)
+			spf_results.WithLabelValues(result).Inc()
+			if result == spfFail && config.RejectSPFFail == "true" {
+				log.Println("rejecting "+addr+" from", peer.Addr, "after spf fail")
+				return smtpd.Error{Code: 550, Message: "5.7.23 SPF validation failed"}
+			}
+		}
+		if err := checkSchedule(schedule, time.Now().In(location)); err != nil {
+			return err
+		}
+		logClientCert(peer)
+		if err := checkClientTLS(peer, client_tls_version, config.ClientCiphers); err != nil {
+			return err
+		}
+		// once per transaction, however many messages its recipients
+		// fan out to
+		tls_inbound.Add(tlsVersionName(peer.TLS))
+		return nil
+	}
+
+	checkRecipient := func(peer smtpd.Peer, addr string) error {
+		if err := checkAddressLength(addr, max_address); err != nil {
+			return err
+		}
+		if err := disk.Accept(); err != nil {
+			log.Println("deferring "+addr+" from", peer.Addr, "while spool space is low")
+			return err
+		}
+		if config.Verp != "" {
+			if _, ok := decodeVERP(config.Verp, addr); ok {
+				return nil
+			}
+		}
+		if _, srsErr := srs.Reverse(addr); srsErr != errNotSRS {
+			if srsErr != nil {
+				log.Println("rejecting srs recipient "+addr, srsErr)
+				return smtpd.Error{Code: 550, Message: "5.1.1 Invalid or expired SRS address"}
+			}
+			return nil
+		}
+
+		_, err := aliases.Lookup(addr)
+		switch err.(type) {
+		case nil:
+			return nil
+		case smtpd.Error:
+			return err
+		}
+
+		alias_misses.Inc()
+		log.Println("rejecting unknown recipient "+addr+" from", peer.Addr)
+		if err == errAliasExpired {
+			return smtpd.Error{Code: 550, Message: "5.1.1 Recipient address expired"}
+		}
+		return smtpd.Error{Code: 550, Message: "5.1.1 Recipient address unknown"}
+	}
+
+	server := &smtpd.Server{
+
+		Hostname:       config.Host,
+		MaxMessageSize: smtpd_message_size,
+		MaxRecipients:  max_recipients,
+
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			atomic.AddInt64(&inflight, 1)
+			defer atomic.AddInt64(&inflight, -1)
+
+			received_at := time.Now()
+			messages_received.Inc()
+
+			if max_message_size > 0 && len(env.Data) > max_message_size {
+				log.Printf("rejecting %d byte message from %s", len(env.Data), env.Sender)
+				return smtpd.Error{Code: 552, Message: "5.3.4 Message size exceeds fixed limit"}
+			}
+
+			env.Data = canonicalLines(env.Data)
+
+			if sizeErr := checkHeaderSize(env.Data, max_header_size); sizeErr != nil {
+				log.Printf("rejecting message from %s with %d bytes of headers", env.Sender, headerSize(env.Data))
+				return sizeErr
+			}
+
+			var dataErr error
+			env.Data, dataErr = checkMessageData(env.Data, env.Sender, config.Host)
+			if dataErr != nil {
+				log.Println("rejecting message from "+env.Sender, dataErr)
+				return dataErr
+			}
+
+			if hopsErr := checkHops(env.Data, max_hops); hopsErr != nil {
+				log.Printf("rejecting message from %s with %d received headers, likely a mail loop", env.Sender, countReceived(env.Data))
+				return hopsErr
+			}
+
+			from_domain := ""
+			has_unsubscribe := false
+			var quarantine_reason error
+			if header, headerErr := messageHeader(env.Data); headerErr == nil {
+				from_domain = headerDomain(header, "From")
+
+				from_group := isGroup(header.Get("From"))
+				if from_group {
+					log.Println("message from " + env.Sender + " has a group From header")
+					if config.Groups == "reject" {
+						return smtpd.Error{Code: 550, Message: "5.6.0 Group syntax not allowed in From header"}
+					}
+				}
+				has_unsubscribe = header.Get("List-Unsubscribe") != "" || header.Get("List-Unsubscribe-Post") != ""
+
+				if score, ok := messageScore(header, score_header); ok && quarantine_score > 0 && score >= quarantine_score {
+					log.Printf("quarantining message from %s with %s %g", env.Sender, score_header, score)
+					quarantine_reason = fmt.Errorf("quarantined with %s %g, at or above %g", score_header, score, quarantine_score)
+				}
+
+				if (config.Alignment == "tag" || config.Alignment == "reject") && !from_group {
+					if sender_domain, ok := misaligned(peer, env.Sender, from_domain, config.TrustedDomains); ok {
+						log.Println("envelope sender " + env.Sender + " does not align with From domain " + from_domain)
+						if config.Alignment == "reject" {
+							return smtpd.Error{Code: 550, Message: "5.7.1 Envelope sender does not match From header"}
+						}
+						env.Data = append([]byte("X-Relayd-Alignment-Warning: envelope "+sender_domain+" header "+from_domain+"\r\n"), env.Data...)
+					}
+				}
+
+				if config.DateCheck == "tag" || config.DateCheck == "reject" {
+					if problem := checkDate(header, time.Now(), date_skew); problem != "" {
+						log.Println(problem + " in message from " + env.Sender)
+						if config.DateCheck == "reject" {
+							return smtpd.Error{Code: 550, Message: "5.7.1 " + problem}
 						}
-						err = client.Mail(env.Sender)
-						defer client.Quit()
-						if err != nil {
-							log.Println("mail-from error", err)
-							return err
+						env.Data = append([]byte("X-Relayd-Date-Warning: "+problem+"\r\n"), env.Data...)
+					}
+				}
+			}
+
+			// SenderChecker already ran the check, so this is answered from
+			// the DNS cache
+			if ip := peerIP(peer.Addr); ip != nil && peer.Username == "" {
+				result := checkSPF(ip, env.Sender, peer.HeloName)
+				env.Data = append(spfHeaders(config.Host, result, ip, env.Sender, peer.HeloName), env.Data...)
+			}
+
+			type delivery struct {
+				recipient   string
+				alias       Alias
+				destination string
+				domain      string
+			}
+			var deliveries []delivery
+			var domains []string
+			seen := make(map[string]bool)
+
+			for _, recipient := range env.Recipients {
+
+				if config.Verp != "" {
+					if failed, ok := decodeVERP(config.Verp, recipient); ok {
+						log.Println("received bounce for " + failed + " from " + env.Sender)
+						continue
+					}
+				}
+
+				// bounces to a rewritten sender go back to the original one
+				if original, srsErr := srs.Reverse(recipient); srsErr != errNotSRS {
+					if srsErr != nil {
+						log.Println("dropping bounce to "+recipient, srsErr)
+						continue
+					}
+					ix := strings.LastIndex(original, "@")
+					domain := original[ix+1:]
+					deliveries = append(deliveries, delivery{recipient, Alias{Source: recipient, Destinations: []string{original}}, original, domain})
+					if !seen[domain] {
+						seen[domain] = true
+						domains = append(domains, domain)
+					}
+					continue
+				}
+
+				// authenticated submissions go to the recipient as given
+				if peer.Username != "" {
+					ix := strings.LastIndex(recipient, "@")
+					domain := recipient[ix+1:]
+					deliveries = append(deliveries, delivery{recipient, Alias{Source: recipient, Destinations: []string{recipient}}, recipient, domain})
+					if !seen[domain] {
+						seen[domain] = true
+						domains = append(domains, domain)
+					}
+					continue
+				}
+
+				// get alias email source -> destination
+				found, err := aliases.Lookup(recipient)
+				if err != nil {
+					if _, ok := err.(smtpd.Error); ok {
+						return err
+					}
+					alias_misses.Inc()
+					continue
+				}
+
+				for _, alias := range found {
+					for _, destination := range alias.Destinations {
+						ix := strings.Index(destination, "@")
+						domain := destination[ix+1:]
+						if !domainAllowed(config.AllowedDestinationDomains, domain) {
+							log.Println("ALERT: refusing to forward " + recipient + " to " + destination + ", " + domain + " is not an allowed destination domain")
+							return smtpd.Error{Code: 550, Message: "5.7.1 Relaying to " + domain + " not allowed"}
 						}
-						err = client.Rcpt(alias.Destination)
-						if err != nil {
-							log.Println("rcpt-to error", err)
-							return err
+						deliveries = append(deliveries, delivery{recipient, alias, destination, domain})
+						if !seen[domain] {
+							seen[domain] = true
+							domains = append(domains, domain)
 						}
+					}
+				}
+			}
+
+			// keep deliveries to the same domain, and so the same MX, together
+			sort.SliceStable(deliveries, func(i, j int) bool {
+				return deliveries[i].domain < deliveries[j].domain
+			})
+
+			route := messageRoute(len(env.Data), big_size, config.BigRoute)
+
+			var mx map[string]mxResult
+			if route == "" {
+				mx = resolveMX(domains, dns_concurrency)
+			}
+
+			received := receivedHeader(peer, config.Host, time.Now())
+
+			sent := make(forwardSet)
+			var failures []error
+			attempted := 0
+			spool_failed := false
+
+			var mutex sync.Mutex
+			type undeliverable struct {
+				recipient   string
+				destination string
+				err         error
+			}
+			var bounces []undeliverable
+			fail := func(recipient string, destination string, err error) {
+				deliveries_failed.WithLabelValues(failureClass(err)).Inc()
+				mutex.Lock()
+				failures = append(failures, err)
+				if !temporaryError(err) {
+					bounces = append(bounces, undeliverable{recipient, destination, err})
+				}
+				mutex.Unlock()
+			}
+			// destinations sharing a domain, sender and body go out in one
+			// session with a RCPT each
+			type batch struct {
+				sender    string
+				body      []byte
+				domain    string
+				mailhosts []string
+				direct    bool
+				targets   []delivery
+			}
+			var batches []*batch
+			batch_index := make(map[[sha256.Size]byte]*batch)
+			// destinations held in the spool until their domain's pause ends
+			type held struct {
+				b   *batch
+				t   delivery
+				err error
+			}
+			var paused []held
+
+			for _, d := range deliveries {
+				recipient, alias, destination, domain := d.recipient, d.alias, d.destination, d.domain
+
+				var mailhosts []string
+				if route != "" {
+					mailhosts = []string{route}
+				} else {
+					if mx[domain].Err == errNullMX {
+						attempted++
+						fail(recipient, destination, smtpd.Error{Code: 556, Message: "5.1.10 " + destination + " does not accept mail (null MX)"})
+						continue
+					}
+					for _, host := range mx[domain].Hosts {
+						mailhosts = append(mailhosts, host+":smtp")
+					}
+				}
+
+				direct := route == ""
+				if direct {
+					if host, ok := fallback.Route(domain); ok {
+						mailhosts = []string{host}
+						direct = false
+					}
+				}
+
+				// with no host, DNS saying there is none fails the
+				// destination; a lookup that failed is retried from the
+				// spool when there is one
+				if len(mailhosts) == 0 {
+					if err := lookupFailure(domain, mx[domain].Err); queue == nil || !temporaryError(err) {
+						attempted++
+						log.Println("cannot deliver to "+destination, err)
+						fail(recipient, destination, err)
+						continue
+					}
+				}
+
+				log.Println("received email for " + recipient + " (helo " + peer.HeloName + ") and forwarding to " + destination + " via " + strings.Join(mailhosts, ", "))
+
+				sender := env.Sender
+				if config.Verp != "" && sender != "" {
+					sender = encodeVERP(config.Verp, destination)
+				} else if peer.Username == "" {
+					sender = srs.Forward(sender)
+				}
+
+				body := env.Data
+				if alias.List && config.Unsubscribe != "" && !has_unsubscribe {
+					body = addUnsubscribe(body, config.Unsubscribe, alias.Source, destination)
+				}
+				body = append(append([]byte(nil), received...), body...)
+				if key := selectDkimKey(config.Dkim, alias, from_domain); key != nil {
+					signed, signErr := key.Sign(body)
+					if signErr != nil {
+						log.Println("dkim signing failed for "+key.Domain, signErr)
+					} else {
+						body = signed
+					}
+				}
+
+				if dedupe && !sent.First(sender, destination, body) {
+					log.Println("skipping duplicate forward of " + recipient + " to " + destination)
+					continue
+				}
+
+				attempted++
+				if err := reputation.Check(domain); err != nil {
+					if queue != nil {
+						paused = append(paused, held{&batch{sender: sender, body: body, domain: domain}, d, err})
+						continue
+					}
+					fail(recipient, destination, err)
+					continue
+				}
+
+				key := sha256.Sum256([]byte(domain + "\x00" + sender + "\x00" + strings.Join(mailhosts, ",") + "\x00" + string(body)))
+				b, ok := batch_index[key]
+				if !ok || len(b.targets) >= 100 {
+					b = &batch{sender: sender, body: body, domain: domain, mailhosts: mailhosts, direct: direct}
+					batches = append(batches, b)
+					batch_index[key] = b
+				}
+				b.targets = append(b.targets, d)
+			}
+
+			queued := func(b *batch, t delivery, err error, after time.Time) *QueueItem {
+				return &QueueItem{
+					Sender:     b.sender,
+					Recipients: []string{t.destination},
+					Data:       b.body,
+					Domain:     b.domain,
+					Route:      route,
+					Tenant:     usageTenant(t.alias, t.recipient, config.UsageKey),
+					ReturnPath: env.Sender,
+					Size:       len(env.Data),
+					LastError:  err.Error(),
+
+					NextAttempt: after,
+					RetryDelays: retrySchedule(t.alias, b.domain),
+				}
+			}
+			spool := func(b *batch, t delivery, err error, after time.Time) {
+				if qErr := queue.Enqueue(queued(b, t, err, after)); qErr != nil {
+					log.Println("ALERT: failed to spool delivery to "+t.destination, qErr)
+					mutex.Lock()
+					spool_failed = true
+					mutex.Unlock()
+				}
+			}
+
+			// a flagged message waits in quarantine until released, and
+			// the queue delivers it from there
+			if quarantine_reason != nil {
+				hold := func(b *batch, t delivery) {
+					if qErr := queue.Quarantine(queued(b, t, quarantine_reason, time.Time{})); qErr != nil {
+						log.Println("ALERT: failed to quarantine delivery to "+t.destination, qErr)
+						spool_failed = true
+					}
+				}
+				for _, b := range batches {
+					for _, t := range b.targets {
+						hold(b, t)
+					}
+				}
+				for _, p := range paused {
+					hold(p.b, p.t)
+				}
+				batches, paused = nil, nil
+			}
 
-						data, writeErr := client.Data()
-						defer data.Close()
+			for _, p := range paused {
+				log.Println("delivery to " + p.b.domain + " paused, spooling " + p.t.destination)
+				spool(p.b, p.t, p.err, reputation.Until(p.b.domain))
+			}
 
-						_, writeErr = data.Write(env.Data)
+			deliver := func(b *batch) {
+				var destinations []string
+				for _, t := range b.targets {
+					destinations = append(destinations, t.destination)
+				}
 
-						if writeErr != nil {
-							log.Println("failed to write data to "+mailhost, writeErr)
-							return writeErr
+				errs := make([]error, len(destinations))
+				for i := range errs {
+					errs[i] = lookupFailure(b.domain, mx[b.domain].Err)
+				}
+				mx_host := ""
+				var duration time.Duration
+				if len(b.mailhosts) > 0 {
+					trace := &deliveryTrace{}
+					started := time.Now()
+					errs = deliverBatch(b.sender, destinations, b.body, b.mailhosts, trace)
+					duration = time.Since(started)
+					delivery_latency.Observe(duration.Seconds())
+					mx_host = trace.Host
+					if trace.Tls != "" {
+						tls_outbound.Add(trace.Tls)
+					}
+					if b.direct {
+						// one observation per session, a success if any
+						// destination took the message
+						observed := errs[0]
+						for _, err := range errs {
+							if err == nil {
+								observed = nil
+							}
 						}
+						fallback.Observe(b.domain, observed)
+					}
+				}
 
+				for i, t := range b.targets {
+					recipient, alias, destination, err := t.recipient, t.alias, t.destination, errs[i]
+					logDelivery(recipient, destination, mx_host, duration, err)
+					if err != nil {
+						reputation.Observe(b.domain, err)
+						if queue != nil && temporaryError(err) {
+							deliveries_failed.WithLabelValues(failureClass(err)).Inc()
+							spool(b, t, err, time.Time{})
+							continue
+						}
+						log.Println("delivery to "+destination+" failed", err)
+						fail(recipient, destination, err)
+						continue
 					}
+
+					messages_delivered.Inc()
+					usage.Record(usageTenant(alias, recipient, config.UsageKey), len(env.Data))
 				}
+			}
+
+			// deliveries run in parallel, at most max_deliveries at a time;
+			// whatever hasn't started by the deadline is spooled
+			var deadline time.Time
+			if delivery_deadline > 0 && queue != nil {
+				deadline = received_at.Add(delivery_deadline)
+			}
+			late := runDeliveries(len(batches), max_deliveries, deadline, func(i int) {
+				deliver(batches[i])
+			}, func(i int) {
+				for _, t := range batches[i].targets {
+					spool(batches[i], t, smtpd.Error{Code: 451, Message: "4.4.7 Delivery deadline passed before this destination was tried"}, time.Time{})
+				}
+			})
+			if late > 0 {
+				log.Printf("delivery deadline passed for message from %s, spooled %d of %d batches", env.Sender, late, len(batches))
+			}
+
+			if replyErr := deliveryReply(attempted, failures, spool_failed); replyErr != nil {
+				return replyErr
+			}
+
+			if len(failures) > 0 {
+				log.Printf("delivered to %d of %d destinations", attempted-len(failures), attempted)
 
+				// the client only hears about total failure, so tell the
+				// sender about the destinations that won't ever get it
+				for _, b := range bounces {
+					sendBounce(queue, env.Sender, b.recipient, b.destination, env.Data, b.err)
+				}
 			}
 			return nil
 		},
 
+		HeloChecker: func(peer smtpd.Peer, name string) error {
+			err := checkHelo(peer, name, config.HeloReject)
+			guard.Reply(peer, "HELO", err)
+			if err == nil && config.TlsPolicy == "drop" {
+				listeners.ExpectSTARTTLS(peer)
+			}
+			return err
+		},
+
+		SenderChecker: func(peer smtpd.Peer, addr string) error {
+			if err := guard.Check(peer, "MAIL"); err != nil {
+				if config.ProtocolPolicy == "disconnect" && tracker != nil {
+					tracker.Drop(peer.Addr, 100*time.Millisecond)
+				}
+				return err
+			}
+			err := checkSender(peer, addr)
+			guard.Reply(peer, "MAIL", err)
+			return err
+		},
+
 		RecipientChecker: func(peer smtpd.Peer, addr string) error {
-			return nil
+			if err := guard.Check(peer, "RCPT"); err != nil {
+				if config.ProtocolPolicy == "disconnect" && tracker != nil {
+					tracker.Drop(peer.Addr, 100*time.Millisecond)
+				}
+				return err
+			}
+			return checkRecipient(peer, addr)
 		},
 
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: certs.GetCertificate,
 		},
+	}
+
+	if config.TLSMinVersion != "" {
+		server.TLSConfig.MinVersion, err = parseTLSVersion(config.TLSMinVersion)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-6)
+		}
+		outbound_min_tls = server.TLSConfig.MinVersion
+	}
+
+	// Go doesn't let TLS 1.3 suites be configured, so this only affects 1.2
+	// and below
+	if len(config.TLSCiphers) > 0 {
+		server.TLSConfig.CipherSuites, err = parseCipherSuites(config.TLSCiphers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-6)
+		}
+	}
 
-		ForceTLS: *force_tls,
+	if len(config.Fingerprints) > 0 {
+		server.TLSConfig.GetConfigForClient = fingerprintFilter(config.Fingerprints)
 	}
 
-	server_bind := config.Bind + ":" + config.Port
-	log.Println("listening on " + server_bind)
+	if config.ClientAuth != "" {
+		if err = configureClientAuth(server.TLSConfig, config.ClientAuth, config.ClientCA); err != nil {
+			fmt.Println(err)
+			os.Exit(-6)
+		}
+	}
 
-	err = server.ListenAndServe(server_bind)
+	// the submission server shares the handler but requires AUTH and lets
+	// authenticated users send to any recipient
+	var submission *smtpd.Server
+	if config.Submission != "" {
+		if config.SubmissionUsers == "" {
+			log.Fatal("need SubmissionUsers to enable the submission listener")
+		}
+		creds, credErr := loadCredentials(config.SubmissionUsers)
+		if credErr != nil {
+			fmt.Println(credErr)
+			os.Exit(-11)
+		}
 
-	if err != nil {
-		log.Fatal(err)
+		submission = &smtpd.Server{
+			Hostname:       config.Host,
+			MaxMessageSize: smtpd_message_size,
+			MaxRecipients:  max_recipients,
+			Handler:        server.Handler,
+			HeloChecker:    server.HeloChecker,
+			Authenticator:  creds.Authenticate,
+
+			SenderChecker: func(peer smtpd.Peer, addr string) error {
+				if peer.Username == "" {
+					return smtpd.Error{Code: 530, Message: "5.7.0 Authentication required"}
+				}
+				return server.SenderChecker(peer, addr)
+			},
+
+			RecipientChecker: func(peer smtpd.Peer, addr string) error {
+				if !strings.Contains(addr, "@") {
+					return smtpd.Error{Code: 501, Message: "5.1.3 Bad recipient address syntax"}
+				}
+				return checkAddressLength(addr, max_address)
+			},
+
+			TLSConfig: server.TLSConfig,
+		}
+	}
+
+	if len(config.Listeners) == 0 {
+		config.Listeners = []ListenerConfig{{Address: net.JoinHostPort(config.Bind, config.Port)}}
+	}
+
+	var sockets []net.Listener
+	var socket_tls []bool
+	for _, spec := range config.Listeners {
+		log.Println("listening on " + spec.Address)
+		socket, listenErr := net.Listen("tcp", spec.Address)
+		if listenErr != nil {
+			log.Fatal(listenErr)
+		}
+		if config.ProxyProtocol == "true" {
+			socket = newProxyListener(socket, 10*time.Second)
+		}
+		sockets = append(sockets, socket)
+		socket_tls = append(socket_tls, spec.Tls == "true" || (spec.Tls == "" && *force_tls))
+	}
+	listeners = newMultiListener(sockets, socket_tls)
+
+	var listener net.Listener = listeners
+
+	if config.MaxConnectionsPerIP != "" {
+		if i, strerr := strconv.Atoi(config.MaxConnectionsPerIP); strerr == nil && i > 0 {
+			listener = newIPLimitListener(listener, i)
+		}
+	}
+
+	if config.Pregreet != "" {
+		if i, strerr := strconv.Atoi(config.Pregreet); strerr == nil && i > 0 {
+			listener = newPregreetListener(listener, time.Duration(i)*time.Second, config.PregreetPolicy == "disconnect")
+		}
+	}
+
+	tracker = newConnTracker(listener)
+	trackers := []*connTracker{tracker}
+
+	var submission_tracker *connTracker
+	if submission != nil {
+		log.Println("submission listening on " + config.Submission)
+		socket, listenErr := net.Listen("tcp", config.Submission)
+		if listenErr != nil {
+			log.Fatal(listenErr)
+		}
+
+		var submission_listener net.Listener = socket
+		if config.ProxyProtocol == "true" {
+			submission_listener = newProxyListener(submission_listener, 10*time.Second)
+		}
+		if config.MaxConnectionsPerIP != "" {
+			if i, strerr := strconv.Atoi(config.MaxConnectionsPerIP); strerr == nil && i > 0 {
+				submission_listener = newIPLimitListener(submission_listener, i)
+			}
+		}
+		submission_tracker = newConnTracker(submission_listener)
+		trackers = append(trackers, submission_tracker)
+	}
+
+	drain_time := 60 * time.Second
+	if config.DrainTime != "" {
+		if i, strerr := strconv.Atoi(config.DrainTime); strerr == nil {
+			drain_time = time.Duration(i) * time.Second
+		}
+	}
+
+	// ShutdownTimeout is the overall deadline, the same as KillTime
+	if config.KillTime == "" {
+		config.KillTime = config.ShutdownTimeout
+	}
+	kill_time := 2 * drain_time
+	if config.KillTime != "" {
+		if i, strerr := strconv.Atoi(config.KillTime); strerr == nil {
+			kill_time = time.Duration(i) * time.Second
+		}
+	}
+
+	queue_stop := make(chan bool)
+	queue_done := make(chan bool)
+	if queue != nil {
+		go func() {
+			queue.Run(queue_stop)
+			close(queue_done)
+		}()
+	} else {
+		close(queue_done)
+	}
+
+	stop_chan := make(chan os.Signal, 1)
+	signal.Notify(stop_chan, syscall.SIGINT, syscall.SIGTERM)
+
+	drained := make(chan bool, 1)
+	go func() {
+		s := <-stop_chan
+		log.Println("received", s)
+
+		go func() {
+			s := <-stop_chan
+			log.Println("received", s, "again, exiting immediately")
+			usage.Flush()
+			os.Exit(1)
+		}()
+
+		start := time.Now()
+		ok := drainConnections(trackers, drain_time, kill_time)
+
+		close(queue_stop)
+		select {
+		case <-queue_done:
+		case <-time.After(kill_time - time.Since(start)):
+			log.Println("queue still busy at shutdown deadline")
+			ok = false
+		}
+		drained <- ok
+	}()
+
+	serve_failed := make(chan error, len(trackers))
+	serve := func(s *smtpd.Server, t *connTracker) {
+		if serveErr := s.Serve(t); serveErr != nil && !t.Closed() {
+			log.Println("listener failed, shutting down:", serveErr)
+			serve_failed <- serveErr
+			select {
+			case stop_chan <- syscall.SIGTERM:
+			default:
+			}
+		}
+	}
+
+	if submission != nil {
+		go serve(submission, submission_tracker)
+	}
+	serve(server, tracker)
+
+	ok := <-drained
+	usage.Flush()
+	if !ok || len(serve_failed) > 0 {
+		log.Println("terminating with deliveries in flight")
+		os.Exit(1)
 	}
 
 	log.Println("terminating")
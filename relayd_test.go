@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bytes"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpstream is a minimal SMTP server that records the commands and
+// messages it receives. It advertises extensions, and STARTTLS when
+// tlsConfig is set. respond may override the reply to any line, including
+// "." ending DATA; returning "" keeps the default.
+type fakeUpstream struct {
+	listener   net.Listener
+	extensions []string
+	tlsConfig  *tls.Config
+	respond    func(line string) string
+
+	mutex    sync.Mutex
+	commands []string
+	messages []string
+}
+
+func newFakeUpstream(t *testing.T, extensions ...string) *fakeUpstream {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUpstream{listener: listener, extensions: extensions}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) Addr() string {
+	return u.listener.Addr().String()
+}
+
+func (u *fakeUpstream) Commands() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string(nil), u.commands...)
+}
+
+// Messages returns each message as it arrived on the wire, still
+// dot-stuffed, with CRLF line endings.
+func (u *fakeUpstream) Messages() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string(nil), u.messages...)
+}
+
+func (u *fakeUpstream) reply(line string, fallback string) string {
+	if u.respond != nil {
+		if reply := u.respond(line); reply != "" {
+			return reply
+		}
+	}
+	return fallback
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake.example.net ESMTP")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		u.mutex.Lock()
+		u.commands = append(u.commands, line)
+		u.mutex.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			extensions := append([]string{"fake.example.net"}, u.extensions...)
+			if u.tlsConfig != nil {
+				if _, ok := conn.(*tls.Conn); !ok {
+					extensions = append(extensions, "STARTTLS")
+				}
+			}
+			if reply := u.reply(line, ""); reply != "" {
+				text.PrintfLine("%s", reply)
+				continue
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			text.PrintfLine("%s", u.reply(line, "220 2.0.0 Ready to start TLS"))
+			secure := tls.Server(conn, u.tlsConfig)
+			if secure.Handshake() != nil {
+				return
+			}
+			conn = secure
+			text = textproto.NewConn(conn)
+		case "DATA":
+			reply := u.reply(line, "354 End data with <CR><LF>.<CR><LF>")
+			text.PrintfLine("%s", reply)
+			if !strings.HasPrefix(reply, "354") {
+				continue
+			}
+			var message strings.Builder
+			for {
+				data, err := text.ReadLine()
+				if err != nil {
+					return
+				}
+				if data == "." {
+					break
+				}
+				message.WriteString(data + "\r\n")
+			}
+			u.mutex.Lock()
+			u.messages = append(u.messages, message.String())
+			u.mutex.Unlock()
+			text.PrintfLine("%s", u.reply(".", "250 2.0.0 Queued"))
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("%s", u.reply(line, "250 2.0.0 OK"))
+		}
+	}
+}
+
+// fakeDNS serves records, given in zone file syntax, to queries for their
+// name and type from a local UDP resolver, and points dns_resolvers at it
+// for the rest of the test. Other names get NXDOMAIN.
+func fakeDNS(t *testing.T, records ...string) {
+	zone := make(map[string][]dns.RR)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := strings.ToLower(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype]
+		zone[key] = append(zone[key], rr)
+	}
+
+	serveDNS(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		question := r.Question[0]
+		m.Answer = zone[strings.ToLower(question.Name)+" "+dns.TypeToString[question.Qtype]]
+		if m.Answer == nil {
+			m.Rcode = dns.RcodeNameError
+			for key := range zone {
+				if strings.HasPrefix(key, strings.ToLower(question.Name)+" ") {
+					m.Rcode = dns.RcodeSuccess
+				}
+			}
+		}
+		w.WriteMsg(m)
+	}))
+}
+
+// serveDNS answers the resolver's queries with handler for the rest of the
+// test.
+func serveDNS(t *testing.T, handler dns.Handler) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	started := make(chan bool)
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+
+	resolvers := dns_resolvers
+	dns_resolvers = []string{conn.LocalAddr().String()}
+	t.Cleanup(func() {
+		dns_resolvers = resolvers
+		server.Shutdown()
+	})
+}
+
+// captureLog sends the standard logger's output to a buffer for the rest of
+// the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestCheckMessageDataReject(t *testing.T) {
+	defer func(policy string) { *data_policy = policy }(*data_policy)
+	*data_policy = "reject"
+
+	for _, test := range []struct {
+		data    string
+		message string
+	}{
+		{"", "5.6.0 Empty message data"},
+		{" \r\n\r\n", "5.6.0 Empty message data"},
+		{"just a body line\r\n", "5.6.0 Message has no headers"},
+		{"\r\nbody after a blank line\r\n", "5.6.0 Message has no headers"},
+	} {
+		_, err := checkMessageData([]byte(test.data), "sender@example.com", "relay.example.net")
+		smtpErr, ok := err.(smtpd.Error)
+		if !ok || smtpErr.Code != 550 || smtpErr.Message != test.message {
+			t.Errorf("checkMessageData(%q) = %v, want 550 %s", test.data, err, test.message)
+		}
+	}
+}
+
+func TestCheckMessageDataSynthesize(t *testing.T) {
+	defer func(policy string) { *data_policy = policy }(*data_policy)
+	*data_policy = "synthesize"
+
+	for _, test := range []struct {
+		sender string
+		from   string
+	}{
+		{"sender@example.com", "From: <sender@example.com>\r\n"},
+		{"", "From: <MAILER-DAEMON@relay.example.net>\r\n"},
+	} {
+		data, err := checkMessageData([]byte("just a body line\r\n"), test.sender, "relay.example.net")
+		if err != nil {
+			t.Fatalf("checkMessageData from %q: %v", test.sender, err)
+		}
+		if !strings.HasPrefix(string(data), test.from) {
+			t.Errorf("synthesized headers from %q start %q, want %q", test.sender, data, test.from)
+		}
+		header, err := messageHeader(data)
+		if err != nil {
+			t.Fatalf("synthesized message does not parse: %v", err)
+		}
+		for _, key := range []string{"From", "Date", "Message-ID"} {
+			if header.Get(key) == "" {
+				t.Errorf("synthesized message lacks %s", key)
+			}
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n\r\njust a body line\r\n")) {
+			t.Errorf("synthesized message %q lost the body", data)
+		}
+	}
+
+	if _, err := checkMessageData(nil, "sender@example.com", "relay.example.net"); err != nil {
+		t.Errorf("empty message not synthesized: %v", err)
+	}
+}
+
+func TestCheckMessageDataWithHeaders(t *testing.T) {
+	original := []byte("Subject: hello\r\n\r\nbody\r\n")
+	data, err := checkMessageData(original, "sender@example.com", "relay.example.net")
+	if err != nil || !bytes.Equal(data, original) {
+		t.Errorf("checkMessageData changed a message with headers: %q, %v", data, err)
+	}
+}
+
+func TestMessageRoute(t *testing.T) {
+	defer func(host string) { smart_host = host }(smart_host)
+	smart_host = ""
+
+	for _, test := range []struct {
+		size  int
+		route string
+	}{
+		{1000, ""},
+		{5000, ""},
+		{5001, "bulk.example.net:25"},
+	} {
+		if route := messageRoute(test.size, 5000, "bulk.example.net:25"); route != test.route {
+			t.Errorf("%d byte message routed to %q, want %q", test.size, route, test.route)
+		}
+	}
+
+	if route := messageRoute(5001, 0, "bulk.example.net:25"); route != "" {
+		t.Errorf("message routed to %q without a BigSize, want its MX", route)
+	}
+
+	smart_host = "smart.example.net:587"
+	if route := messageRoute(5001, 5000, "bulk.example.net:25"); route != smart_host {
+		t.Errorf("message routed to %q with a smart host, want %q", route, smart_host)
+	}
+}
+
+func TestBindAddressSkipsProbe(t *testing.T) {
+	// an unknown network makes any probe fail
+	if bind, err := bindAddress("192.0.2.10", "", "bogus", "192.0.2.1:80"); err != nil || bind != "192.0.2.10" {
+		t.Errorf("explicit Bind gave %q, %v, want it used without probing", bind, err)
+	}
+	if bind, err := bindAddress("", "192.0.2.20", "bogus", "192.0.2.1:80"); err != nil || bind != "192.0.2.20" {
+		t.Errorf("explicit interface gave %q, %v, want it used without probing", bind, err)
+	}
+	if _, err := bindAddress("", "", "bogus", "192.0.2.1:80"); err == nil {
+		t.Error("probe with an unknown network succeeded")
+	}
+
+	if bind, err := bindAddress("", "", "udp", "127.0.0.1:9"); err != nil || bind != "127.0.0.1" {
+		t.Errorf("udp probe of a loopback target gave %q, %v, want 127.0.0.1", bind, err)
+	}
+}
+
+func TestUnicodeLocalPart(t *testing.T) {
+	defer func(policy string) { *utf8_policy = policy }(*utf8_policy)
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	plain := newFakeUpstream(t)
+	for _, policy := range []string{"reject", "downgrade"} {
+		*utf8_policy = policy
+		errs := deliverMessage("sender@example.com", []string{"jösé@example.org"}, body, plain.Addr(), nil)
+		if smtpErr, ok := errs[0].(smtpd.Error); !ok || smtpErr.Code != 550 || !strings.HasPrefix(smtpErr.Message, "5.6.7") {
+			t.Errorf("unicode local part to an upstream without SMTPUTF8 under %s: got %v, want 550 5.6.7", policy, errs[0])
+		}
+	}
+	for _, command := range plain.Commands() {
+		if strings.HasPrefix(command, "RCPT") {
+			t.Errorf("upstream without SMTPUTF8 was sent %q", command)
+		}
+	}
+
+	*utf8_policy = "downgrade"
+	errs := deliverMessage("sender@example.com", []string{"user@bücher.example"}, body, plain.Addr(), nil)
+	if errs[0] != nil {
+		t.Errorf("unicode domain not downgraded: %v", errs[0])
+	}
+	if !hasCommand(plain.Commands(), "RCPT TO:<user@xn--bcher-kva.example>") {
+		t.Errorf("upstream got %q, want the domain downgraded to punycode", plain.Commands())
+	}
+
+	*utf8_policy = "reject"
+	utf8 := newFakeUpstream(t, "SMTPUTF8")
+	errs = deliverMessage("sender@example.com", []string{"jösé@example.org"}, body, utf8.Addr(), nil)
+	if errs[0] != nil {
+		t.Fatalf("unicode local part to an SMTPUTF8 upstream: %v", errs[0])
+	}
+	commands := utf8.Commands()
+	if !hasCommand(commands, "MAIL FROM:<sender@example.com> SMTPUTF8") || !hasCommand(commands, "RCPT TO:<jösé@example.org>") {
+		t.Errorf("SMTPUTF8 upstream got %q, want MAIL with SMTPUTF8 and the recipient unchanged", commands)
+	}
+}
+
+func hasCommand(commands []string, want string) bool {
+	for _, command := range commands {
+		if command == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDebugDNSLog(t *testing.T) {
+	defer func(debug bool) { *debug_dns = debug }(*debug_dns)
+	*debug_dns = true
+	fakeDNS(t,
+		"debug.example. 300 IN MX 10 mx1.debug.example.",
+		"debug.example. 600 IN MX 20 mx2.debug.example.")
+	output := captureLog(t)
+
+	hosts, err := getMX("debug.example")
+	if err != nil || len(hosts) != 2 || hosts[0] != "mx1.debug.example" || hosts[1] != "mx2.debug.example" {
+		t.Fatalf("getMX = %v, %v, want both hosts in preference order", hosts, err)
+	}
+	if _, err := getMX("debug.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"dns: debug.example MX answered by " + dns_resolvers[0] + " in ",
+		"with 2 records",
+		"dns: debug.example MX 10 mx1.debug.example. ttl=300",
+		"dns: debug.example MX 20 mx2.debug.example. ttl=600",
+		"dns: debug.example order [mx1.debug.example mx2.debug.example]",
+		"dns: debug.example MX from cache",
+	} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("debug log lacks %q:\n%s", want, output)
+		}
+	}
+
+	*debug_dns = false
+	output.Reset()
+	if _, err := getMX("debug.example"); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("lookup without debug-dns logged %q", output)
+	}
+}
+
+func TestCheckAddressLength(t *testing.T) {
+	domain := func(length int) string {
+		return strings.Repeat("d", length-len(".example")) + ".example"
+	}
+	local64 := strings.Repeat("l", 64)
+
+	for _, test := range []struct {
+		addr    string
+		max     int
+		message string
+	}{
+		{local64 + "@example.com", 254, ""},
+		{local64 + "l@example.com", 254, "5.1.3 Local part too long"},
+		{"user@" + domain(254-5), 254, ""},
+		{"user@" + domain(255-5), 254, "5.1.3 Address too long"},
+		{"user@" + domain(255-5), 320, ""},
+		{local64 + "@" + domain(320-65), 320, ""},
+		{local64 + "@" + domain(321-65), 320, "5.1.3 Address too long"},
+		{strings.Repeat("x", 4096), 320, "5.1.3 Address too long"},
+	} {
+		err := checkAddressLength(test.addr, test.max)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("address of %d octets with a limit of %d: got %v", len(test.addr), test.max, err)
+			}
+			continue
+		}
+		if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 501 || smtpErr.Message != test.message {
+			t.Errorf("address of %d octets with a limit of %d: got %v, want a 501 %s", len(test.addr), test.max, err, test.message)
+		}
+	}
+}
+
+func TestForwardSetOverlappingAliases(t *testing.T) {
+	aliases := []Alias{
+		{Source: "team@example.com", Destinations: []string{"alice@example.org", "bob@example.org"}},
+		{Source: "ops@example.com", Destinations: []string{"alice@example.org", "carol@example.org"}},
+		{Source: "news@example.com", Destinations: []string{"alice@example.org"}, List: true},
+	}
+	data := []byte("Subject: hello\r\n\r\nbody\r\n")
+
+	sent := make(forwardSet)
+	var delivered []string
+	for _, alias := range aliases {
+		for _, destination := range alias.Destinations {
+			body := data
+			if alias.List {
+				body = addUnsubscribe(body, "mailto:unsubscribe@example.com", alias.Source, destination)
+			}
+			if sent.First("sender@example.net", destination, body) {
+				delivered = append(delivered, alias.Source+" "+destination)
+			}
+		}
+	}
+
+	want := []string{
+		"team@example.com alice@example.org",
+		"team@example.com bob@example.org",
+		"ops@example.com carol@example.org",
+		// the list copy carries its own List-Unsubscribe, so differs
+		"news@example.com alice@example.org",
+	}
+	if strings.Join(delivered, ", ") != strings.Join(want, ", ") {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+
+	if !sent.First("other@example.net", "alice@example.org", data) {
+		t.Error("forward with a different envelope sender treated as a duplicate")
+	}
+}
+
+func TestDeliveryDeadlineSpoolsRemainder(t *testing.T) {
+	var mutex sync.Mutex
+	var delivered, queued []int
+	deliver := func(i int) {
+		// a slow upstream
+		time.Sleep(200 * time.Millisecond)
+		mutex.Lock()
+		delivered = append(delivered, i)
+		mutex.Unlock()
+	}
+	spool := func(i int) {
+		mutex.Lock()
+		queued = append(queued, i)
+		mutex.Unlock()
+	}
+
+	// one at a time: the first two start before the deadline, the rest
+	// would start after it
+	late := runDeliveries(4, 1, time.Now().Add(300*time.Millisecond), deliver, spool)
+	if late != 2 || len(delivered) != 2 || delivered[0] != 0 || delivered[1] != 1 || len(queued) != 2 || queued[0] != 2 || queued[1] != 3 {
+		t.Errorf("deadline after two batches delivered %v and queued %v (%d late), want 0 and 1 delivered and 2 and 3 queued", delivered, queued, late)
+	}
+
+	delivered, queued = nil, nil
+	if late := runDeliveries(4, 4, time.Time{}, deliver, spool); late != 0 || len(delivered) != 4 || len(queued) != 0 {
+		t.Errorf("no deadline delivered %v and queued %v", delivered, queued)
+	}
+}
+
+func TestDotStuffingOnTheWire(t *testing.T) {
+	upstream := newFakeUpstream(t)
+
+	for _, test := range []struct {
+		data string
+		wire string
+	}{
+		// smtpd hands over unstuffed data; leading dots go back out doubled
+		{"Subject: dots\r\n\r\n.hidden\r\n..two\r\nmiddle . dot\r\n", "Subject: dots\r\n\r\n..hidden\r\n...two\r\nmiddle . dot\r\n"},
+		// a body of a single dot must not end DATA early
+		{"Subject: dot\r\n\r\n.", "Subject: dot\r\n\r\n..\r\n"},
+		// no trailing newline, and bare LF endings
+		{"Subject: bare\n\n.first\nlast", "Subject: bare\r\n\r\n..first\r\nlast\r\n"},
+	} {
+		body := canonicalLines([]byte(test.data))
+		errs := deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), nil)
+		if errs[0] != nil {
+			t.Fatalf("delivery of %q: %v", test.data, errs[0])
+		}
+		messages := upstream.Messages()
+		if got := messages[len(messages)-1]; got != test.wire {
+			t.Errorf("%q went out as %q, want %q", test.data, got, test.wire)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+)
+
+// reloadable are the Config fields a SIGHUP applies in place. A change to
+// any other field only takes effect after a restart.
+var reloadable = map[string]bool{
+	"Cert":     true,
+	"Key":      true,
+	"Time":     true,
+	"Url":      true,
+	"Backends": true,
+}
+
+func loadConfig(path string) (Config, error) {
+	var config Config
+
+	json_data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(json_data, &config); err != nil {
+		return config, errors.New("failed to parse " + path + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// restartFields returns the settings that differ between the running and
+// the reloaded config but can't be applied without a restart.
+func restartFields(running Config, reloaded Config) []string {
+	var fields []string
+
+	a := reflect.ValueOf(running)
+	b := reflect.ValueOf(reloaded)
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
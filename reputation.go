@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"log"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultBlockPatterns = []string{
+	"blocklist", "blacklist", "block list", "black list", "spamhaus",
+	"listed", "reputation", "rbl", "dnsbl",
+}
+
+// reputationGuard pauses delivery to destination domains whose upstreams
+// answer with responses suggesting our address has been blocklisted.
+type reputationGuard struct {
+	sync.Mutex
+	patterns []string
+	cooldown time.Duration
+	paused   map[string]time.Time
+}
+
+func newReputationGuard(patterns []string, cooldown time.Duration) *reputationGuard {
+	if len(patterns) == 0 {
+		patterns = defaultBlockPatterns
+	}
+	return &reputationGuard{patterns: patterns, cooldown: cooldown, paused: make(map[string]time.Time)}
+}
+
+func (g *reputationGuard) Check(domain string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	until, ok := g.paused[domain]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(until) {
+		delete(g.paused, domain)
+		log.Println("resuming delivery to " + domain)
+		return nil
+	}
+	return smtpd.Error{Code: 451, Message: "4.7.0 Delivery to " + domain + " paused"}
+}
+
+// Until returns when the pause on delivery to domain ends, or the zero time
+// when it isn't paused.
+func (g *reputationGuard) Until(domain string) time.Time {
+	g.Lock()
+	defer g.Unlock()
+	return g.paused[domain]
+}
+
+// Observe pauses domain when err is an upstream reply matching one of the
+// blocklist patterns.
+func (g *reputationGuard) Observe(domain string, err error) {
+	tpErr, ok := err.(*textproto.Error)
+	if !ok {
+		return
+	}
+
+	msg := strings.ToLower(tpErr.Msg)
+	for _, pattern := range g.patterns {
+		if strings.Contains(msg, strings.ToLower(pattern)) {
+			g.Lock()
+			g.paused[domain] = time.Now().Add(g.cooldown)
+			g.Unlock()
+			log.Printf("ALERT: %s appears to blocklist us (%d %s), pausing delivery for %v", domain, tpErr.Code, tpErr.Msg, g.cooldown)
+			return
+		}
+	}
+}
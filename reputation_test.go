@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReputationPausesBlocklistedDestination(t *testing.T) {
+	reply := "451 4.7.1 Service unavailable; client host [192.0.2.1] listed by zen.spamhaus.org"
+	upstream := newFakeUpstream(t)
+	upstream.respond = func(line string) string {
+		if strings.HasPrefix(line, "RCPT") {
+			return reply
+		}
+		return ""
+	}
+	guard := newReputationGuard(nil, 100*time.Millisecond)
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	errs := deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), nil)
+	guard.Observe("example.org", errs[0])
+	err := guard.Check("example.org")
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 451 || !strings.Contains(smtpErr.Message, "paused") {
+		t.Errorf("destination answering %q: got %v, want delivery paused", reply, err)
+	}
+	if err = guard.Check("example.net"); err != nil {
+		t.Errorf("other destination paused: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err = guard.Check("example.org"); err != nil {
+		t.Errorf("destination still paused after the cooldown: %v", err)
+	}
+
+	// an ordinary deferral is no reputation signal
+	reply = "451 4.3.0 Mailbox temporarily unavailable"
+	errs = deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), nil)
+	guard.Observe("example.org", errs[0])
+	if err = guard.Check("example.org"); err != nil {
+		t.Errorf("destination paused after %q: %v", reply, err)
+	}
+}
+
+func TestPausedDestinationWaitsInSpool(t *testing.T) {
+	guard := newReputationGuard(nil, time.Hour)
+	guard.Observe("example.org", &textproto.Error{Code: 451, Msg: "4.7.1 Client host listed by zen.spamhaus.org"})
+	until := guard.Until("example.org")
+	if until.Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("paused until %v, want an hour from now", until)
+	}
+	if !guard.Until("example.net").IsZero() {
+		t.Error("unpaused destination has a pause end")
+	}
+
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &QueueItem{Recipients: []string{"user@example.org"}, Domain: "example.org", LastError: guard.Check("example.org").Error(), NextAttempt: until}
+	if err = q.Enqueue(item); err != nil {
+		t.Fatal(err)
+	}
+	queued := spooled(t, q.dir)
+	if len(queued) != 1 || queued[0].NextAttempt.Before(until) {
+		t.Errorf("paused destination spooled as %+v, want it due when the pause ends at %v", queued, until)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Window struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("invalid time " + clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return errors.New("invalid day " + bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return errors.New("invalid day " + bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseWindow parses a schedule entry such as "Mon-Fri 09:00-17:00" or
+// "22:00-06:00". Without days the window applies every day; a window ending
+// before it starts runs past midnight.
+func parseWindow(spec string) (Window, error) {
+	var window Window
+
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, errors.New("invalid schedule " + spec)
+	}
+
+	if len(fields) == 2 {
+		if err := parseDays(fields[0], &window.Days); err != nil {
+			return window, err
+		}
+	} else {
+		for d := range window.Days {
+			window.Days[d] = true
+		}
+	}
+
+	times := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(times) != 2 {
+		return window, errors.New("invalid schedule " + spec)
+	}
+
+	var err error
+	if window.Start, err = parseClock(times[0]); err != nil {
+		return window, err
+	}
+	if window.End, err = parseClock(times[1]); err != nil {
+		return window, err
+	}
+
+	return window, nil
+}
+
+func (window Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if window.Start <= window.End {
+		return window.Days[day] && minute >= window.Start && minute < window.End
+	}
+
+	yesterday := (day + 6) % 7
+	return (window.Days[day] && minute >= window.Start) || (window.Days[yesterday] && minute < window.End)
+}
+
+func scheduleOpen(windows []Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, window := range windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSchedule defers mail arriving at t outside every window.
+func checkSchedule(windows []Window, t time.Time) error {
+	if !scheduleOpen(windows, t) {
+		return smtpd.Error{Code: 451, Message: "4.3.2 Not accepting mail at this time"}
+	}
+	return nil
+}
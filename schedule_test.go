@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"testing"
+	"time"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	var windows []Window
+	for _, spec := range []string{"Mon-Fri 09:00-17:00", "Sat 22:00-02:00"} {
+		window, err := parseWindow(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, window)
+	}
+
+	location := time.FixedZone("relay", 2*60*60)
+	for _, test := range []struct {
+		when     time.Time
+		accepted bool
+	}{
+		{time.Date(2026, 10, 14, 9, 0, 0, 0, location), true},   // Wednesday morning
+		{time.Date(2026, 10, 14, 16, 59, 0, 0, location), true}, // Wednesday afternoon
+		{time.Date(2026, 10, 14, 17, 0, 0, 0, location), false}, // Wednesday evening
+		{time.Date(2026, 10, 14, 8, 59, 0, 0, location), false}, // Wednesday before opening
+		{time.Date(2026, 10, 17, 23, 0, 0, 0, location), true},  // Saturday night
+		{time.Date(2026, 10, 18, 1, 30, 0, 0, location), true},  // past midnight into Sunday
+		{time.Date(2026, 10, 18, 12, 0, 0, 0, location), false}, // Sunday noon
+	} {
+		err := checkSchedule(windows, test.when)
+		if test.accepted && err != nil {
+			t.Errorf("mail at %s deferred: %v", test.when.Format("Mon 15:04"), err)
+		}
+		if smtpErr, ok := err.(smtpd.Error); !test.accepted && (!ok || smtpErr.Code != 451) {
+			t.Errorf("mail at %s: got %v, want a 451", test.when.Format("Mon 15:04"), err)
+		}
+	}
+
+	// the window is read in the server's timezone, not UTC
+	if err := checkSchedule(windows, time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC).In(location)); err != nil {
+		t.Errorf("08:00 UTC is 10:00 in the relay's timezone, got %v", err)
+	}
+	if err := checkSchedule(nil, time.Date(2026, 10, 18, 12, 0, 0, 0, location)); err != nil {
+		t.Errorf("mail deferred without a schedule: %v", err)
+	}
+}
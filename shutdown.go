@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var inflight int64
+
+type connTracker struct {
+	net.Listener
+	sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func newConnTracker(l net.Listener) *connTracker {
+	return &connTracker{Listener: l, conns: make(map[net.Conn]bool)}
+}
+
+func (t *connTracker) Accept() (net.Conn, error) {
+	conn, err := t.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	tc := &trackedConn{conn, t}
+	t.conns[tc] = true
+	return tc, nil
+}
+
+func (t *connTracker) Close() error {
+	t.Lock()
+	t.closed = true
+	t.Unlock()
+	return t.Listener.Close()
+}
+
+func (t *connTracker) Closed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.closed
+}
+
+func (t *connTracker) Active() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) CloseAll() {
+	t.Lock()
+	var conns []net.Conn
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.Lock()
+	delete(c.tracker.conns, c)
+	c.tracker.Unlock()
+	return c.Conn.Close()
+}
+
+// drainConnections stops accepting and waits for open sessions and in-flight
+// deliveries. Sessions still open after drainTimeout are force-closed; it
+// gives up at killTimeout and reports whether everything finished.
+func drainConnections(trackers []*connTracker, drainTimeout time.Duration, killTimeout time.Duration) bool {
+	start := time.Now()
+	for _, tracker := range trackers {
+		tracker.Close()
+	}
+
+	forced := false
+	for {
+		active := 0
+		for _, tracker := range trackers {
+			active += tracker.Active()
+		}
+		pending := atomic.LoadInt64(&inflight)
+
+		if active == 0 && pending == 0 {
+			log.Println("all connections drained")
+			return true
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= killTimeout {
+			log.Printf("kill deadline reached with %d connections and %d deliveries in flight", active, pending)
+			return false
+		}
+
+		if !forced && elapsed >= drainTimeout {
+			log.Printf("drain timeout reached, force-closing %d connections", active)
+			for _, tracker := range trackers {
+				tracker.CloseAll()
+			}
+			forced = true
+		} else {
+			log.Printf("draining %d connections and %d deliveries", active, pending)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Drop closes the connection from addr after delay, giving smtpd time to
+// write its reply first.
+func (t *connTracker) Drop(addr net.Addr, delay time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	for conn := range t.conns {
+		if conn.RemoteAddr().String() == addr.String() {
+			time.AfterFunc(delay, func() { conn.Close() })
+			return
+		}
+	}
+}
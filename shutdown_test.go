@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainForceClosesHungConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newConnTracker(listener)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := tracker.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session that never finishes on its own
+	hung := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		hung <- err
+	}()
+
+	start := time.Now()
+	if !drainConnections([]*connTracker{tracker}, 0, 5*time.Second) {
+		t.Error("drain reported failure after force-closing the only connection")
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("drain took %s, want the hung connection closed before the kill deadline", elapsed)
+	}
+
+	select {
+	case <-hung:
+	case <-time.After(time.Second):
+		t.Fatal("hung session still reading after the drain")
+	}
+	if active := tracker.Active(); active != 0 {
+		t.Errorf("%d connections still tracked after the drain", active)
+	}
+	if !tracker.Closed() {
+		t.Error("listener still accepting after the drain")
+	}
+}
+
+func TestDrainKillDeadline(t *testing.T) {
+	atomic.AddInt64(&inflight, 1)
+	defer atomic.AddInt64(&inflight, -1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drainConnections([]*connTracker{newConnTracker(listener)}, 0, 0) {
+		t.Error("drain reported success with a delivery still in flight at the kill deadline")
+	}
+}
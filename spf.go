@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+// spfMaxLookups is the RFC 7208 limit on mechanisms that query DNS.
+const spfMaxLookups = 10
+
+var errSPFPerm = errors.New("invalid spf record")
+
+type dnsEntry struct {
+	answer  []dns.RR
+	expires time.Time
+}
+
+// SPF evaluation queries TXT, A, AAAA and MX records, cached like MX
+// answers with the same TTL bounds.
+var spf_cache = struct {
+	sync.Mutex
+	entries map[string]dnsEntry
+}{entries: make(map[string]dnsEntry)}
+
+// lookupSPF returns the answer for name and qtype, empty when the name
+// doesn't exist.
+func lookupSPF(name string, qtype uint16) ([]dns.RR, error) {
+	key := strings.ToLower(dns.Fqdn(name)) + " " + dns.TypeToString[qtype]
+
+	spf_cache.Lock()
+	entry, ok := spf_cache.entries[key]
+	spf_cache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.answer, nil
+	}
+
+	r, _, _, err := queryDNS(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, errors.New("name lookup failed with code " + dns.RcodeToString[r.Rcode])
+	}
+
+	var answer []dns.RR
+	lifetime := mx_ttl_max
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		answer = append(answer, rr)
+		if ttl := time.Duration(rr.Header().Ttl) * time.Second; ttl < lifetime {
+			lifetime = ttl
+		}
+	}
+	if len(answer) == 0 || lifetime < mx_ttl_min {
+		lifetime = mx_ttl_min
+	}
+
+	spf_cache.Lock()
+	defer spf_cache.Unlock()
+	now := time.Now()
+	for key, entry := range spf_cache.entries {
+		if !now.Before(entry.expires) {
+			delete(spf_cache.entries, key)
+		}
+	}
+	spf_cache.entries[key] = dnsEntry{answer, now.Add(lifetime)}
+	return answer, nil
+}
+
+type spfCheck struct {
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+}
+
+// checkSPF evaluates the SPF policy of the sender domain, or of the HELO
+// name for the null sender, for a message from ip.
+func checkSPF(ip net.IP, sender string, helo string) string {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	ix := strings.LastIndex(sender, "@")
+	if ix < 0 {
+		sender = "postmaster@" + sender
+		ix = strings.LastIndex(sender, "@")
+	}
+
+	c := &spfCheck{ip: ip, sender: sender, helo: helo}
+	result, err := c.evaluate(sender[ix+1:], 0)
+	if err == errSPFPerm {
+		return spfPermError
+	} else if err != nil {
+		return spfTempError
+	}
+	return result
+}
+
+func (c *spfCheck) record(domain string) (string, error) {
+	answer, err := lookupSPF(domain, dns.TypeTXT)
+	if err != nil {
+		return "", err
+	}
+
+	var records []string
+	for _, rr := range answer {
+		txt := strings.Join(rr.(*dns.TXT).Txt, "")
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", errSPFPerm
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+func (c *spfCheck) evaluate(domain string, depth int) (string, error) {
+	if depth > spfMaxLookups {
+		return "", errSPFPerm
+	}
+
+	record, err := c.record(domain)
+	if err != nil {
+		return "", err
+	}
+	if record == "" {
+		return spfNone, nil
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if eq := strings.Index(term, "="); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			if strings.EqualFold(term[:eq], "redirect") {
+				redirect = term[eq+1:]
+			}
+			continue
+		}
+
+		result := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = spfFail, term[1:]
+		case '~':
+			result, term = spfSoftFail, term[1:]
+		case '?':
+			result, term = spfNeutral, term[1:]
+		}
+
+		matched, err := c.match(term, domain, depth)
+		if err != nil {
+			return "", err
+		}
+		if matched {
+			return result, nil
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > spfMaxLookups {
+			return "", errSPFPerm
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		result, err := c.evaluate(target, depth+1)
+		if err == nil && result == spfNone {
+			return "", errSPFPerm
+		}
+		return result, err
+	}
+	return spfNeutral, nil
+}
+
+// match reports whether mechanism matches the client address.
+func (c *spfCheck) match(mechanism string, domain string, depth int) (bool, error) {
+	name, arg := mechanism, ""
+	if ix := strings.IndexAny(mechanism, ":/"); ix >= 0 {
+		name, arg = mechanism[:ix], mechanism[ix:]
+		arg = strings.TrimPrefix(arg, ":")
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, errSPFPerm
+		}
+		return network.Contains(c.ip), nil
+	}
+
+	if c.lookups++; c.lookups > spfMaxLookups {
+		return false, errSPFPerm
+	}
+
+	// a, mx and exists take an optional domain and a, mx dual cidr lengths
+	target, cidr4, cidr6 := arg, 32, 128
+	if name == "a" || name == "mx" {
+		if ix := strings.Index(target, "//"); ix >= 0 {
+			n, err := strconv.Atoi(target[ix+2:])
+			if err != nil || n < 0 || n > 128 {
+				return false, errSPFPerm
+			}
+			target, cidr6 = target[:ix], n
+		}
+		if ix := strings.Index(target, "/"); ix >= 0 {
+			n, err := strconv.Atoi(target[ix+1:])
+			if err != nil || n < 0 || n > 32 {
+				return false, errSPFPerm
+			}
+			target, cidr4 = target[:ix], n
+		}
+	}
+	if target == "" {
+		target = domain
+	} else {
+		var err error
+		if target, err = c.expand(target, domain); err != nil {
+			return false, err
+		}
+	}
+
+	switch name {
+	case "include":
+		if arg == "" {
+			return false, errSPFPerm
+		}
+		result, err := c.evaluate(target, depth+1)
+		if err != nil {
+			return false, err
+		}
+		if result == spfNone {
+			return false, errSPFPerm
+		}
+		return result == spfPass, nil
+	case "a":
+		return c.matchHost(target, cidr4, cidr6)
+	case "mx":
+		answer, err := lookupSPF(target, dns.TypeMX)
+		if err != nil {
+			return false, err
+		}
+		if len(answer) > spfMaxLookups {
+			return false, errSPFPerm
+		}
+		for _, rr := range answer {
+			matched, err := c.matchHost(rr.(*dns.MX).Mx, cidr4, cidr6)
+			if matched || err != nil {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "exists":
+		answer, err := lookupSPF(target, dns.TypeA)
+		return len(answer) > 0, err
+	case "ptr":
+		// deprecated and expensive, never matches here
+		return false, nil
+	}
+	return false, errSPFPerm
+}
+
+func (c *spfCheck) matchHost(host string, cidr4 int, cidr6 int) (bool, error) {
+	qtype, bits, size := dns.TypeAAAA, cidr6, 128
+	if c.ip.To4() != nil {
+		qtype, bits, size = dns.TypeA, cidr4, 32
+	}
+
+	answer, err := lookupSPF(host, qtype)
+	if err != nil {
+		return false, err
+	}
+
+	mask := net.CIDRMask(bits, size)
+	for _, rr := range answer {
+		var addr net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			addr = record.A
+		case *dns.AAAA:
+			addr = record.AAAA
+		}
+		if addr != nil && addr.Mask(mask).Equal(c.ip.Mask(mask)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand substitutes the RFC 7208 macros in spec.
+func (c *spfCheck) expand(spec string, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	ix := strings.LastIndex(c.sender, "@")
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPerm
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = c.sender[:ix]
+		case "o":
+			value = c.sender[ix+1:]
+		case "d":
+			value = domain
+		case "h":
+			value = c.helo
+		case "i":
+			if ip4 := c.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				var nibbles []string
+				for _, b := range c.ip.To16() {
+					nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&15), 16))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		case "v":
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		default:
+			return "", errSPFPerm
+		}
+
+		// transformers: keep the rightmost n parts, r reverses, then the
+		// delimiters to split on
+		rest := macro[1:]
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		keep, _ := strconv.Atoi(rest[:digits])
+		rest = rest[digits:]
+		reverse := strings.HasPrefix(strings.ToLower(rest), "r")
+		if reverse {
+			rest = rest[1:]
+		}
+		if rest == "" {
+			rest = "."
+		}
+
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(rest, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		out.WriteString(strings.Join(parts, "."))
+	}
+	return out.String(), nil
+}
+
+// peerIP returns the IP of a connecting peer, or nil.
+func peerIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+const srsBase32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// srsMaxAge is how long a rewritten sender stays valid for bounces.
+const srsMaxAge = 21
+
+var errNotSRS = errors.New("not an srs address")
+var errSRSInvalid = errors.New("srs address has an invalid hash")
+var errSRSExpired = errors.New("srs address expired")
+
+// srsRewriter implements the Sender Rewriting Scheme, so forwarded mail
+// carries a MAIL FROM at our own domain and passes SPF:
+// user@example.com becomes SRS0=HHHH=TT=example.com=user@srs.example.net,
+// where HHHH is an HMAC over the rest and TT the day it was issued.
+type srsRewriter struct {
+	domain string
+	secret []byte
+}
+
+func newSRSRewriter(domain string, secret string) *srsRewriter {
+	return &srsRewriter{domain: strings.ToLower(domain), secret: []byte(secret)}
+}
+
+func (r *srsRewriter) hash(stamp string, domain string, local string) string {
+	mac := hmac.New(sha1.New, r.secret)
+	mac.Write([]byte(strings.ToLower(stamp + domain + local)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func srsStamp(now time.Time) string {
+	day := (now.Unix() / 86400) % 1024
+	return string([]byte{srsBase32[day>>5], srsBase32[day&31]})
+}
+
+// srsAge returns the days since stamp was issued, or -1 when it is
+// malformed.
+func srsAge(stamp string, now time.Time) int {
+	if len(stamp) != 2 {
+		return -1
+	}
+	hi := strings.IndexByte(srsBase32, strings.ToUpper(stamp)[0])
+	lo := strings.IndexByte(srsBase32, strings.ToUpper(stamp)[1])
+	if hi < 0 || lo < 0 {
+		return -1
+	}
+	today := int((now.Unix() / 86400) % 1024)
+	return (today - (hi<<5 | lo) + 1024) % 1024
+}
+
+// Forward rewrites sender to an SRS address. The null sender and addresses
+// already at the SRS domain are left alone.
+func (r *srsRewriter) Forward(sender string) string {
+	if r == nil || sender == "" {
+		return sender
+	}
+	ix := strings.LastIndex(sender, "@")
+	if ix < 0 || strings.EqualFold(sender[ix+1:], r.domain) {
+		return sender
+	}
+
+	local, domain := sender[:ix], sender[ix+1:]
+	stamp := srsStamp(time.Now())
+	return "SRS0=" + r.hash(stamp, domain, local) + "=" + stamp + "=" + domain + "=" + local + "@" + r.domain
+}
+
+// Reverse returns the original sender encoded in addr. It returns
+// errNotSRS when addr isn't an SRS address at our domain.
+func (r *srsRewriter) Reverse(addr string) (string, error) {
+	if r == nil {
+		return "", errNotSRS
+	}
+	ix := strings.LastIndex(addr, "@")
+	if ix < 0 || !strings.EqualFold(addr[ix+1:], r.domain) || len(addr) < 5 || !strings.EqualFold(addr[:5], "SRS0=") {
+		return "", errNotSRS
+	}
+
+	parts := strings.SplitN(addr[5:ix], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", errSRSInvalid
+	}
+	hash, stamp, domain, local := parts[0], parts[1], parts[2], parts[3]
+
+	if !hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(r.hash(stamp, domain, local)))) {
+		return "", errSRSInvalid
+	}
+	if age := srsAge(stamp, time.Now()); age < 0 || age > srsMaxAge {
+		return "", errSRSExpired
+	}
+	return local + "@" + domain, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+type tlsCounter struct {
+	sync.Mutex
+	versions map[string]int64
+}
+
+var tls_inbound = &tlsCounter{versions: make(map[string]int64)}
+var tls_outbound = &tlsCounter{versions: make(map[string]int64)}
+
+func tlsVersionName(state *tls.ConnectionState) string {
+	if state == nil {
+		return "none"
+	}
+	return tls.VersionName(state.Version)
+}
+
+func (c *tlsCounter) Add(version string) {
+	c.Lock()
+	c.versions[version]++
+	c.Unlock()
+}
+
+// Summary returns the count and share of each TLS version, with "none"
+// counting cleartext transactions.
+func (c *tlsCounter) Summary() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	var total int64
+	for _, n := range c.versions {
+		total += n
+	}
+
+	versions := make(map[string]interface{})
+	for version, n := range c.versions {
+		versions[version] = map[string]interface{}{
+			"Count": n,
+			"Rate":  float64(n) / float64(total),
+		}
+	}
+
+	return map[string]interface{}{"Total": total, "Versions": versions}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSCounterTransactions(t *testing.T) {
+	server := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "relay.example.net")}}
+	modern, err := handshake(t, server, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	older, err := handshake(t, server, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counter := &tlsCounter{versions: make(map[string]int64)}
+	for _, state := range []*tls.ConnectionState{&modern, &modern, &older, nil} {
+		counter.Add(tlsVersionName(state))
+	}
+
+	summary := counter.Summary()
+	if summary["Total"] != int64(4) {
+		t.Errorf("counted %v transactions, want 4", summary["Total"])
+	}
+	versions := summary["Versions"].(map[string]interface{})
+	for version, want := range map[string]float64{"TLS 1.3": 0.5, "TLS 1.2": 0.25, "none": 0.25} {
+		entry, ok := versions[version].(map[string]interface{})
+		if !ok || entry["Rate"] != want || entry["Count"] != int64(want*4) {
+			t.Errorf("%s counted %v, want %v of 4 transactions", version, versions[version], want*4)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"bufio"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"os"
+	"strings"
+)
+
+// credentials holds the submission users from SubmissionUsers, one
+// "user:bcrypt-hash" pair per line as written by htpasswd -B.
+type credentials map[string][]byte
+
+func loadCredentials(path string) (credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	creds := make(credentials)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ix := strings.Index(line, ":")
+		if ix < 1 {
+			return nil, errors.New("malformed credentials line in " + path)
+		}
+		creds[line[:ix]] = []byte(line[ix+1:])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, errors.New("no credentials in " + path)
+	}
+	return creds, nil
+}
+
+// Authenticate is the smtpd Authenticator for the submission listener.
+func (c credentials) Authenticate(peer smtpd.Peer, username, password string) error {
+	if peer.TLS == nil {
+		return smtpd.Error{Code: 538, Message: "5.7.11 Encryption required for requested authentication mechanism"}
+	}
+
+	hash, ok := c[username]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		log.Println("failed submission login for "+username+" from", peer.Addr)
+		return smtpd.Error{Code: 535, Message: "5.7.8 Authentication credentials invalid"}
+	}
+	return nil
+}
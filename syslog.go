@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// openSyslog connects to the local syslog daemon, logging to facility, mail
+// when empty.
+func openSyslog(facility string) (io.Writer, error) {
+	if facility == "" {
+		facility = "mail"
+	}
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("invalid syslog facility " + facility)
+	}
+	return syslog.New(priority|syslog.LOG_INFO, "relayd")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(version, "TLS")]
+	if !ok {
+		return 0, errors.New("invalid tls version " + version)
+	}
+	return v, nil
+}
+
+// parseCipherSuites maps cipher suite names as Go spells them, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown cipher suite " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// cipherStrength reports whether a negotiated cipher suite meets the
+// configured strength: "secure" excludes suites Go considers insecure,
+// "forward" additionally requires forward secrecy and an AEAD cipher.
+func cipherStrength(state *tls.ConnectionState, strength string) bool {
+	if state.Version >= tls.VersionTLS13 {
+		return true
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.ID == state.CipherSuite && strength != "" && strength != "any" {
+			return false
+		}
+	}
+
+	if strength == "forward" {
+		name := tls.CipherSuiteName(state.CipherSuite)
+		if !strings.Contains(name, "_ECDHE_") {
+			return false
+		}
+		return strings.Contains(name, "_GCM_") || strings.Contains(name, "CHACHA20")
+	}
+
+	return true
+}
+
+func checkClientTLS(peer smtpd.Peer, minVersion uint16, strength string) error {
+	if peer.TLS == nil {
+		return nil
+	}
+
+	if peer.TLS.Version < minVersion {
+		return smtpd.Error{Code: 530, Message: "5.7.0 TLS version " + tls.VersionName(peer.TLS.Version) + " below required minimum"}
+	}
+
+	if !cipherStrength(peer.TLS, strength) {
+		return smtpd.Error{Code: 530, Message: "5.7.0 TLS cipher " + tls.CipherSuiteName(peer.TLS.CipherSuite) + " below required strength"}
+	}
+
+	return nil
+}
+
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func joinValues(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		if !isGrease(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// helloFingerprint computes a JA3-style hash of the ClientHello. The legacy
+// record version is not exposed by crypto/tls, so it is derived from the
+// supported versions list.
+func helloFingerprint(hello *tls.ClientHelloInfo) string {
+	version := uint16(tls.VersionTLS12)
+	for _, v := range hello.SupportedVersions {
+		if v < version && !isGrease(v) {
+			version = v
+		}
+	}
+
+	var curves []uint16
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+
+	var points []uint16
+	for _, p := range hello.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+
+	ja3 := strconv.Itoa(int(version)) + "," +
+		joinValues(hello.CipherSuites) + "," +
+		joinValues(hello.Extensions) + "," +
+		joinValues(curves) + "," +
+		joinValues(points)
+
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprintFilter returns a GetConfigForClient hook rejecting handshakes
+// whose fingerprint is in deny. Anything unexpected fails open.
+func fingerprintFilter(deny []string) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	blocked := make(map[string]bool)
+	for _, fp := range deny {
+		blocked[strings.ToLower(fp)] = true
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello == nil {
+			return nil, nil
+		}
+
+		fp := helloFingerprint(hello)
+		if blocked[fp] {
+			if hello.Conn != nil {
+				log.Println("rejecting tls handshake with blocked fingerprint "+fp+" from", hello.Conn.RemoteAddr())
+			}
+			return nil, errors.New("blocked tls fingerprint")
+		}
+
+		return nil, nil
+	}
+}
+
+// errNoStartTLS is the failure of a host that doesn't offer STARTTLS when
+// OutboundTLS requires it.
+var errNoStartTLS = smtpd.Error{Code: 451, Message: "4.7.5 Upstream does not offer STARTTLS"}
+
+type handshakeError struct {
+	err       error
+	diagnosis string
+}
+
+func (e *handshakeError) Error() string {
+	return "tls handshake failed (" + e.diagnosis + "): " + e.err.Error()
+}
+
+// diagnoseTLS classifies a handshake error so interop problems can be told
+// apart in the logs.
+func diagnoseTLS(err error) string {
+	var unknownCA x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &unknownCA):
+		return "unknown certificate authority"
+	case errors.As(err, &hostname):
+		return "certificate name mismatch"
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return "certificate expired or not yet valid"
+		}
+		return "invalid certificate"
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "protocol version"):
+		return "protocol version mismatch"
+	case strings.Contains(msg, "no cipher suite"), strings.Contains(msg, "handshake failure"):
+		return "cipher mismatch"
+	case strings.Contains(msg, "does not look like a TLS handshake"):
+		return "peer is not speaking tls"
+	}
+
+	return "handshake error"
+}
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+	"verify":  tls.VerifyClientCertIfGiven,
+	"enforce": tls.RequireAndVerifyClientCert,
+}
+
+// configureClientAuth asks inbound clients for certificates, verified
+// against the PEM bundle in caFile for the verifying modes.
+func configureClientAuth(config *tls.Config, mode string, caFile string) error {
+	auth, ok := clientAuthModes[mode]
+	if !ok {
+		return errors.New("invalid client certificate mode " + mode)
+	}
+	config.ClientAuth = auth
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificates in " + caFile)
+		}
+		config.ClientCAs = pool
+	}
+	return nil
+}
+
+type certInfo struct {
+	Subject     string
+	Issuer      string
+	Fingerprint string
+}
+
+// clientCert describes the certificate the peer presented, or returns nil
+// when it presented none.
+func clientCert(peer smtpd.Peer) *certInfo {
+	if peer.TLS == nil || len(peer.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := peer.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	return &certInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+}
+
+// logClientCert logs the certificate the peer presented, for audit, and
+// returns its details.
+func logClientCert(peer smtpd.Peer) *certInfo {
+	cert := clientCert(peer)
+	if cert != nil {
+		log.Printf("client certificate from %v: subject=%q issuer=%q sha256=%s", peer.Addr, cert.Subject, cert.Issuer, cert.Fingerprint)
+	}
+	return cert
+}
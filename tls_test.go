@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for names, valid from
+// an hour ago until tomorrow.
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"relayd test"}},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// handshake runs a TLS handshake between server and client over a pipe and
+// returns the server's view of the connection, as smtpd reports it in
+// Peer.TLS, and the client's error.
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan tls.ConnectionState)
+	go func() {
+		conn := tls.Server(serverConn, server)
+		conn.Handshake()
+		serverConn.Close()
+		done <- conn.ConnectionState()
+	}()
+
+	err := tls.Client(clientConn, client).Handshake()
+	clientConn.Close()
+	return <-done, err
+}
+
+func TestCheckClientTLSCipher(t *testing.T) {
+	server := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "relay.example.net")},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		},
+	}
+
+	for _, test := range []struct {
+		cipher   uint16
+		strength string
+		allowed  bool
+	}{
+		{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, "forward", true},
+		{tls.TLS_RSA_WITH_AES_128_GCM_SHA256, "forward", false},
+		{tls.TLS_RSA_WITH_AES_128_GCM_SHA256, "any", true},
+		{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, "secure", false},
+		{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, "any", true},
+	} {
+		client := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{test.cipher}}
+		state, err := handshake(t, server, client)
+		if err != nil {
+			t.Fatalf("handshake with %s: %v", tls.CipherSuiteName(test.cipher), err)
+		}
+
+		err = checkClientTLS(smtpd.Peer{TLS: &state}, tls.VersionTLS12, test.strength)
+		if test.allowed && err != nil {
+			t.Errorf("%s rejected under %q: %v", tls.CipherSuiteName(test.cipher), test.strength, err)
+		}
+		if !test.allowed {
+			smtpErr, ok := err.(smtpd.Error)
+			if !ok || smtpErr.Code != 530 || !strings.Contains(smtpErr.Message, "below required strength") {
+				t.Errorf("%s under %q: got %v, want a 530 strength rejection", tls.CipherSuiteName(test.cipher), test.strength, err)
+			}
+		}
+	}
+}
+
+func TestCheckClientTLSVersion(t *testing.T) {
+	server := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "relay.example.net")}}
+	client := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	state, err := handshake(t, server, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkClientTLS(smtpd.Peer{TLS: &state}, tls.VersionTLS13, "")
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 530 || !strings.Contains(smtpErr.Message, "below required minimum") {
+		t.Errorf("TLS 1.2 against a 1.3 minimum: got %v, want a 530 version rejection", err)
+	}
+
+	if err = checkClientTLS(smtpd.Peer{}, tls.VersionTLS13, "forward"); err != nil {
+		t.Errorf("cleartext session rejected by the cipher check: %v", err)
+	}
+}
+
+func TestFingerprintFilter(t *testing.T) {
+	cert := testCertificate(t, "relay.example.net")
+	blocked := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+	other := &tls.Config{InsecureSkipVerify: true}
+
+	var fingerprint string
+	capture := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			fingerprint = helloFingerprint(hello)
+			return nil, nil
+		},
+	}
+	if _, err := handshake(t, capture, blocked); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, GetConfigForClient: fingerprintFilter([]string{strings.ToUpper(fingerprint)})}
+	if _, err := handshake(t, server, blocked); err == nil {
+		t.Errorf("handshake with blocked fingerprint %s succeeded", fingerprint)
+	}
+	if _, err := handshake(t, server, other); err != nil {
+		t.Errorf("handshake with an unlisted fingerprint failed: %v", err)
+	}
+
+	if config, err := fingerprintFilter([]string{fingerprint})(nil); config != nil || err != nil {
+		t.Errorf("filter without a ClientHello returned %v, %v, want it to fail open", config, err)
+	}
+}
+
+func TestDiagnoseTLS(t *testing.T) {
+	cert := testCertificate(t, "relay.example.net")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	for _, test := range []struct {
+		server    *tls.Config
+		client    *tls.Config
+		diagnosis string
+	}{
+		{server, &tls.Config{ServerName: "relay.example.net"}, "unknown certificate authority"},
+		{server, &tls.Config{ServerName: "other.example.net", RootCAs: roots}, "certificate name mismatch"},
+		{
+			&tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12},
+			&tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13},
+			"protocol version mismatch",
+		},
+		{
+			&tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+			&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}},
+			"cipher mismatch",
+		},
+	} {
+		_, err := handshake(t, test.server, test.client)
+		if err == nil {
+			t.Errorf("handshake expected to fail with %s succeeded", test.diagnosis)
+			continue
+		}
+		if diagnosis := diagnoseTLS(err); diagnosis != test.diagnosis {
+			t.Errorf("diagnoseTLS(%v) = %q, want %q", err, diagnosis, test.diagnosis)
+		}
+	}
+}
+
+func TestStartTLSFailureFallsBackToCleartext(t *testing.T) {
+	defer func(fallback bool, policy string) { *tls_fallback, *outbound_tls = fallback, policy }(*tls_fallback, *outbound_tls)
+	*outbound_tls = "prefer"
+
+	// a certificate relayd can't verify for the upstream's address
+	upstream := newFakeUpstream(t)
+	upstream.tlsConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.org")}}
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	*tls_fallback = false
+	errs := deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), nil)
+	tlsErr, ok := errs[0].(*handshakeError)
+	if !ok || tlsErr.diagnosis != "certificate name mismatch" {
+		t.Fatalf("delivery without fallback: got %v, want a diagnosed handshake error", errs[0])
+	}
+	if smtpErr, ok := deliveryError(errs[0]).(smtpd.Error); !ok || smtpErr.Code != 451 {
+		t.Errorf("handshake failure reported as %v, want a 451", deliveryError(errs[0]))
+	}
+	if len(upstream.Messages()) != 0 {
+		t.Fatal("message delivered without fallback")
+	}
+
+	*tls_fallback = true
+	trace := &deliveryTrace{}
+	errs = deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), trace)
+	if errs[0] != nil {
+		t.Fatalf("delivery with fallback: %v", errs[0])
+	}
+	if trace.Tls != "none" || len(upstream.Messages()) != 1 {
+		t.Errorf("fallback delivered %d messages with tls %q, want one in cleartext", len(upstream.Messages()), trace.Tls)
+	}
+}
+
+func TestAllMXFailTLSPolicyDefers(t *testing.T) {
+	defer func(fallback bool, policy string) { *tls_fallback, *outbound_tls = fallback, policy }(*tls_fallback, *outbound_tls)
+	*tls_fallback, *outbound_tls = false, "require"
+
+	var mailhosts []string
+	var upstreams []*fakeUpstream
+	for i := 0; i < 2; i++ {
+		upstream := newFakeUpstream(t)
+		upstream.tlsConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.org")}}
+		mailhosts = append(mailhosts, upstream.Addr())
+		upstreams = append(upstreams, upstream)
+	}
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	errs := deliverBatch("sender@example.com", []string{"user@example.org"}, body, mailhosts, nil)
+	if _, ok := errs[0].(*handshakeError); !ok {
+		t.Fatalf("delivery to MX hosts failing TLS validation: got %v, want a handshake error", errs[0])
+	}
+	for i, upstream := range upstreams {
+		if !hasCommand(upstream.Commands(), "STARTTLS") {
+			t.Errorf("MX %d saw no handshake attempt", i+1)
+		}
+	}
+
+	// the same for hosts not offering STARTTLS at all
+	var cleartext []*fakeUpstream
+	var cleartextHosts []string
+	for i := 0; i < 2; i++ {
+		upstream := newFakeUpstream(t)
+		cleartext = append(cleartext, upstream)
+		cleartextHosts = append(cleartextHosts, upstream.Addr())
+	}
+	if errs := deliverBatch("sender@example.com", []string{"user@example.org"}, body, cleartextHosts, nil); errs[0] != errNoStartTLS {
+		t.Errorf("delivery to MX hosts without STARTTLS: got %v, want errNoStartTLS", errs[0])
+	}
+	for i, upstream := range cleartext {
+		commands := upstream.Commands()
+		if !hasCommand(commands, "EHLO "+*hostname) {
+			t.Errorf("MX %d without STARTTLS wasn't tried", i+1)
+		}
+		for _, command := range commands {
+			if strings.HasPrefix(command, "MAIL") {
+				t.Errorf("MX %d without STARTTLS got %q in cleartext", i+1, command)
+			}
+		}
+	}
+	if !temporaryError(errs[0]) {
+		t.Error("TLS policy failure treated as permanent")
+	}
+	if smtpErr, ok := deliveryError(errs[0]).(smtpd.Error); !ok || smtpErr.Code != 451 || !strings.HasPrefix(smtpErr.Message, "4.7.5") {
+		t.Errorf("sender got %v, want 451 4.7.5", deliveryError(errs[0]))
+	}
+
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(q.dir, "tls.json")
+	item := &QueueItem{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@example.org"},
+		Data:       body,
+		Domain:     "example.org",
+		Route:      mailhosts[0],
+		ReturnPath: "sender@example.com",
+	}
+	if err = writeItem(path, item); err != nil {
+		t.Fatal(err)
+	}
+	q.attempt(path, item)
+
+	retrying := spooled(t, q.dir)
+	if len(retrying) != 1 || retrying[0].Attempts != 1 || !retrying[0].NextAttempt.After(time.Now()) {
+		t.Errorf("spool holds %+v, want the item kept for a retry and no bounce", retrying)
+	}
+	if deferred := spooled(t, q.deferredDir()); len(deferred) != 0 {
+		t.Errorf("TLS policy failure gave up on %d items", len(deferred))
+	}
+}
+
+func TestLogClientCert(t *testing.T) {
+	logged := captureLog(t)
+	client := testCertificate(t, "submit.example.com")
+	server := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "relay.example.net")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+
+	state, err := handshake(t, server, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 587}, TLS: &state}
+	cert := logClientCert(peer)
+
+	sum := sha256.Sum256(client.Leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	if cert == nil || cert.Fingerprint != fingerprint || !strings.Contains(cert.Subject, "CN=submit.example.com") || !strings.Contains(cert.Issuer, "O=relayd test") {
+		t.Fatalf("client certificate details %+v, want subject and issuer of submit.example.com and sha256 %s", cert, fingerprint)
+	}
+	for _, want := range []string{"client certificate from 192.0.2.1:587", "subject=\"" + cert.Subject + "\"", "sha256=" + fingerprint} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log %q lacks %q", logged.String(), want)
+		}
+	}
+
+	// the same details are what authorization sees
+	if got := clientCert(peer); got == nil || *got != *cert {
+		t.Errorf("clientCert(peer) = %+v, want %+v", got, cert)
+	}
+
+	logged.Reset()
+	state, err = handshake(t, &tls.Config{Certificates: server.Certificates}, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := logClientCert(smtpd.Peer{Addr: peer.Addr, TLS: &state}); cert != nil || logged.Len() != 0 {
+		t.Errorf("connection without a client certificate gave %+v and logged %q", cert, logged.String())
+	}
+}
+
+func TestIgnoredExtensionFallsBack(t *testing.T) {
+	defer func(fallback bool, policy string, utf8 string, ignored map[string][]string) {
+		*tls_fallback, *outbound_tls, *utf8_policy, ignore_extensions = fallback, policy, utf8, ignored
+	}(*tls_fallback, *outbound_tls, *utf8_policy, ignore_extensions)
+	*tls_fallback, *outbound_tls, *utf8_policy = false, "prefer", "reject"
+	ignore_extensions = nil
+
+	// claims STARTTLS but can't complete a handshake relayd accepts
+	upstream := newFakeUpstream(t, "SMTPUTF8")
+	upstream.tlsConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.org")}}
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	errs := deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), nil)
+	if _, ok := errs[0].(*handshakeError); !ok {
+		t.Fatalf("delivery to the broken upstream: got %v, want a handshake error", errs[0])
+	}
+
+	ignore_extensions = map[string][]string{"example.org": {"starttls", "SMTPUTF8"}}
+	trace := &deliveryTrace{}
+	errs = deliverMessage("sender@example.com", []string{"user@example.org"}, body, upstream.Addr(), trace)
+	if errs[0] != nil {
+		t.Fatalf("delivery ignoring STARTTLS: %v", errs[0])
+	}
+	if trace.Tls != "none" || len(upstream.Messages()) != 1 {
+		t.Errorf("delivered %d messages with tls %q, want one in cleartext", len(upstream.Messages()), trace.Tls)
+	}
+
+	// SMTPUTF8 ignored too, so a unicode local part gets the policy for
+	// upstreams without it
+	errs = deliverMessage("sender@example.com", []string{"jösé@example.org"}, body, upstream.Addr(), nil)
+	if smtpErr, ok := errs[0].(smtpd.Error); !ok || smtpErr.Code != 550 {
+		t.Errorf("unicode local part with SMTPUTF8 ignored: got %v, want a 550", errs[0])
+	}
+
+	// by MX host name as well as destination domain
+	host, _, _ := net.SplitHostPort(upstream.Addr())
+	ignore_extensions = map[string][]string{host: {"STARTTLS"}}
+	if errs = deliverMessage("sender@example.com", []string{"user@example.net"}, body, upstream.Addr(), nil); errs[0] != nil {
+		t.Errorf("delivery ignoring STARTTLS for host %s: %v", host, errs[0])
+	}
+	starttls := 0
+	for _, command := range upstream.Commands() {
+		if command == "STARTTLS" {
+			starttls++
+		}
+	}
+	if starttls != 1 {
+		t.Errorf("upstream got STARTTLS %d times, want only the first delivery to try it", starttls)
+	}
+}
+
+func TestOutboundTLSPolicy(t *testing.T) {
+	defer func(fallback bool, policy string) { *tls_fallback, *outbound_tls = fallback, policy }(*tls_fallback, *outbound_tls)
+	*tls_fallback = false
+	body := []byte("Subject: hi\r\n\r\nhi\r\n")
+
+	cleartext := newFakeUpstream(t)
+	*outbound_tls = "require"
+	errs := deliverMessage("sender@example.com", []string{"user@example.org"}, body, cleartext.Addr(), nil)
+	if smtpErr, ok := errs[0].(smtpd.Error); !ok || smtpErr.Code != 451 || !strings.HasPrefix(smtpErr.Message, "4.7.5") {
+		t.Errorf("require to an upstream without STARTTLS: got %v, want 451 4.7.5", errs[0])
+	}
+	if hasCommand(cleartext.Commands(), "MAIL FROM:<sender@example.com>") || len(cleartext.Messages()) != 0 {
+		t.Error("require sent the message in cleartext")
+	}
+	if !hasCommand(cleartext.Commands(), "EHLO "+*hostname) {
+		t.Errorf("upstream got %q, want EHLO with the configured hostname", cleartext.Commands())
+	}
+
+	*outbound_tls = "prefer"
+	trace := &deliveryTrace{}
+	errs = deliverMessage("sender@example.com", []string{"user@example.org"}, body, cleartext.Addr(), trace)
+	if errs[0] != nil || trace.Tls != "none" || len(cleartext.Messages()) != 1 {
+		t.Errorf("prefer to an upstream without STARTTLS: %v with tls %q, want it delivered in cleartext", errs[0], trace.Tls)
+	}
+
+	// none never tries STARTTLS, so a broken one doesn't matter
+	broken := newFakeUpstream(t)
+	broken.tlsConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.org")}}
+	*outbound_tls = "none"
+	errs = deliverMessage("sender@example.com", []string{"user@example.org"}, body, broken.Addr(), nil)
+	if errs[0] != nil || hasCommand(broken.Commands(), "STARTTLS") || len(broken.Messages()) != 1 {
+		t.Errorf("none to an upstream offering STARTTLS: %v after %q, want it delivered without STARTTLS", errs[0], broken.Commands())
+	}
+}
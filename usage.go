@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Usage struct {
+	Messages int64
+	Bytes    int64
+}
+
+// UsageStore counts deliveries per tenant. Record writes the counts through
+// to path, so a crash or SIGKILL loses none that were recorded; a write that
+// fails is retried every usageFlushInterval and at shutdown, and only the
+// deliveries since the last good write are lost if relayd dies before then.
+type UsageStore struct {
+	sync.Mutex
+	path    string
+	Tenants map[string]*Usage
+
+	dirty  bool
+	saving sync.Mutex
+}
+
+var usageFlushInterval = 10 * time.Second
+
+func loadUsage(path string) (*UsageStore, error) {
+	store, err := readUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			store.Flush()
+		}
+	}()
+	return store, nil
+}
+
+func readUsage(path string) (*UsageStore, error) {
+	store := &UsageStore{path: path, Tenants: make(map[string]*Usage)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &store.Tenants); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// usageTenant returns the billing key for a delivery, either the alias tenant
+// tag or the recipient domain.
+func usageTenant(alias Alias, recipient string, key string) string {
+	if key == "tag" && alias.Tenant != "" {
+		return alias.Tenant
+	}
+	ix := strings.LastIndex(recipient, "@")
+	return strings.ToLower(recipient[ix+1:])
+}
+
+func (store *UsageStore) Record(tenant string, size int) {
+	if store == nil {
+		return
+	}
+
+	store.Lock()
+	usage, ok := store.Tenants[tenant]
+	if !ok {
+		usage = &Usage{}
+		store.Tenants[tenant] = usage
+	}
+	usage.Messages++
+	usage.Bytes += int64(size)
+	store.dirty = true
+	store.Unlock()
+
+	tenant_messages.WithLabelValues(tenant).Inc()
+	tenant_bytes.WithLabelValues(tenant).Add(float64(size))
+
+	store.Flush()
+}
+
+// Snapshot returns a copy of the counters.
+func (store *UsageStore) Snapshot() map[string]Usage {
+	snapshot := make(map[string]Usage)
+	if store == nil {
+		return snapshot
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	for tenant, usage := range store.Tenants {
+		snapshot[tenant] = *usage
+	}
+	return snapshot
+}
+
+// Flush writes the counters to the usage file if they changed since the
+// last write.
+func (store *UsageStore) Flush() {
+	if store == nil {
+		return
+	}
+
+	store.saving.Lock()
+	defer store.saving.Unlock()
+
+	store.Lock()
+	if !store.dirty {
+		store.Unlock()
+		return
+	}
+	data, err := json.Marshal(store.Tenants)
+	store.dirty = false
+	store.Unlock()
+
+	if err == nil {
+		tmp := store.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0640); err == nil {
+			err = os.Rename(tmp, store.path)
+		}
+	}
+	if err != nil {
+		log.Println("failed to save usage to "+store.path, err)
+		store.Lock()
+		store.dirty = true
+		store.Unlock()
+	}
+}
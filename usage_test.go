@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// counterValue reads a counter from the default registry, zero when the
+// label combination was never counted.
+func counterValue(t *testing.T, name string, label string, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestUsageTenant(t *testing.T) {
+	tagged := Alias{Source: "sales@example.com", Destinations: []string{"bob@example.org"}, Tenant: "acme"}
+	untagged := Alias{Source: "info@example.com", Destinations: []string{"eve@example.org"}}
+
+	for _, test := range []struct {
+		alias     Alias
+		recipient string
+		key       string
+		tenant    string
+	}{
+		{tagged, "sales@Example.COM", "", "example.com"},
+		{tagged, "sales@example.com", "tag", "acme"},
+		{untagged, "info@example.com", "tag", "example.com"},
+	} {
+		if tenant := usageTenant(test.alias, test.recipient, test.key); tenant != test.tenant {
+			t.Errorf("usageTenant(%s, %q) = %q, want %q", test.recipient, test.key, tenant, test.tenant)
+		}
+	}
+}
+
+func TestUsageRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	store, err := readUsage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := counterValue(t, "relayd_tenant_messages_delivered_total", "tenant", "acme")
+	store.Record("acme", 100)
+	store.Record("acme", 50)
+	store.Record("example.org", 10)
+
+	snapshot := store.Snapshot()
+	if snapshot["acme"] != (Usage{Messages: 2, Bytes: 150}) {
+		t.Errorf("acme usage = %+v, want 2 messages and 150 bytes", snapshot["acme"])
+	}
+	if snapshot["example.org"] != (Usage{Messages: 1, Bytes: 10}) {
+		t.Errorf("example.org usage = %+v, want 1 message and 10 bytes", snapshot["example.org"])
+	}
+	if got := counterValue(t, "relayd_tenant_messages_delivered_total", "tenant", "acme") - before; got != 2 {
+		t.Errorf("acme message counter went up by %v, want 2", got)
+	}
+
+	// written through, as if relayd was killed right after
+	reloaded, err := readUsage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := reloaded.Snapshot()["acme"]; usage != (Usage{Messages: 2, Bytes: 150}) {
+		t.Errorf("acme usage after reload = %+v, want 2 messages and 150 bytes", usage)
+	}
+}
+
+func TestUsageFlushKeepsChangesOnError(t *testing.T) {
+	dir := t.TempDir()
+	store, err := readUsage(filepath.Join(dir, "missing", "usage.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Record("acme", 1)
+	store.Flush()
+
+	os.Mkdir(filepath.Join(dir, "missing"), 0750)
+	store.Flush()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "missing", "usage.json"))
+	if err != nil || len(data) == 0 {
+		t.Errorf("usage not written once the directory exists: %v", err)
+	}
+}
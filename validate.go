@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateConfig checks the settings relayd can't run without and returns
+// every problem found, so a broken config is fixed in one pass.
+func validateConfig(config Config, sources []string, refresh int) []error {
+	var problems []error
+
+	if config.ACMEEnabled == "true" && config.CertSource != "acme" {
+		problems = append(problems, errors.New("ACMEEnabled conflicts with CertSource "+config.CertSource))
+	}
+
+	switch config.CertSource {
+	case "", "file":
+		if config.Cert == "" || config.Key == "" {
+			problems = append(problems, errors.New("need Cert and Key, or CertSource acme"))
+		} else if _, err := tls.LoadX509KeyPair(config.Cert, config.Key); err != nil {
+			problems = append(problems, fmt.Errorf("cannot load certificate %s: %v", config.Cert, err))
+		}
+	case "acme":
+		if len(config.ACMEDomains) == 0 {
+			problems = append(problems, errors.New("need ACMEDomains for CertSource acme"))
+		}
+	default:
+		problems = append(problems, errors.New("invalid certificate source "+config.CertSource))
+	}
+
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, errors.New("invalid bind port "+config.Port))
+	}
+
+	for _, spec := range config.Listeners {
+		if _, port, err := net.SplitHostPort(spec.Address); err != nil || port == "" {
+			problems = append(problems, errors.New("invalid listener address "+spec.Address))
+		}
+		if spec.Tls != "" && spec.Tls != "true" && spec.Tls != "false" {
+			problems = append(problems, errors.New("invalid listener tls setting "+spec.Tls+" for "+spec.Address))
+		}
+	}
+
+	if config.SmartHost != "" {
+		if _, port, err := net.SplitHostPort(config.SmartHost); err != nil || port == "" {
+			problems = append(problems, errors.New("invalid smart host "+config.SmartHost+", need host:port"))
+		}
+	}
+	if config.SmartHostUser != "" && config.SmartHost == "" {
+		problems = append(problems, errors.New("SmartHostUser is set but SmartHost is not"))
+	}
+
+	if config.SRSDomain != "" && config.SRSSecret == "" {
+		problems = append(problems, errors.New("need SRSSecret to enable SRS"))
+	}
+
+	if config.DKIMKeyFile != "" && config.DKIMSelector == "" {
+		problems = append(problems, errors.New("need DKIMSelector with DKIMKeyFile"))
+	}
+
+	switch config.HeaderlessPolicy {
+	case "", "reject", "synthesize":
+	default:
+		problems = append(problems, errors.New("invalid HeaderlessPolicy "+config.HeaderlessPolicy+", need reject or synthesize"))
+	}
+
+	for domain, spec := range config.RetrySchedules {
+		if _, err := parseRetrySchedule(spec); err != nil {
+			problems = append(problems, errors.New(err.Error()+" for "+domain))
+		}
+	}
+
+	if config.DeliveryDeadline != "" {
+		if i, err := strconv.Atoi(config.DeliveryDeadline); err != nil || i <= 0 {
+			problems = append(problems, errors.New("invalid DeliveryDeadline "+config.DeliveryDeadline+", need a positive number of seconds"))
+		} else if config.QueueDir == "" {
+			problems = append(problems, errors.New("DeliveryDeadline needs QueueDir to spool the remainder"))
+		}
+	}
+
+	if config.MinFreeSpace != "" {
+		if i, err := strconv.Atoi(config.MinFreeSpace); err != nil || i <= 0 {
+			problems = append(problems, errors.New("invalid MinFreeSpace "+config.MinFreeSpace+", need a positive number of megabytes"))
+		} else if config.QueueDir == "" {
+			problems = append(problems, errors.New("MinFreeSpace needs QueueDir to watch"))
+		}
+	}
+
+	if config.MaxBounces != "" {
+		if i, err := strconv.Atoi(config.MaxBounces); err != nil || i <= 0 {
+			problems = append(problems, errors.New("invalid MaxBounces "+config.MaxBounces+", need a positive number"))
+		} else if config.QueueDir == "" {
+			problems = append(problems, errors.New("MaxBounces needs QueueDir to hold bounces in"))
+		}
+	}
+	if config.BounceWindow != "" {
+		if i, err := strconv.Atoi(config.BounceWindow); err != nil || i <= 0 {
+			problems = append(problems, errors.New("invalid BounceWindow "+config.BounceWindow+", need a positive number of seconds"))
+		} else if config.MaxBounces == "" {
+			problems = append(problems, errors.New("BounceWindow needs MaxBounces to limit"))
+		}
+	}
+
+	if config.QuarantineScore != "" {
+		if f, err := strconv.ParseFloat(config.QuarantineScore, 64); err != nil || f <= 0 {
+			problems = append(problems, errors.New("invalid QuarantineScore "+config.QuarantineScore+", need a positive score"))
+		} else if config.QueueDir == "" {
+			problems = append(problems, errors.New("QuarantineScore needs QueueDir to hold messages in"))
+		}
+	}
+	if config.ScoreHeader != "" && config.QuarantineScore == "" {
+		problems = append(problems, errors.New("ScoreHeader is set but QuarantineScore is not"))
+	}
+
+	if config.Postmaster != "" {
+		ix := strings.LastIndex(config.Postmaster, "@")
+		if ix < 0 {
+			problems = append(problems, errors.New("invalid Postmaster "+config.Postmaster+", need an address"))
+		} else {
+			domain := config.Postmaster[ix+1:]
+			for _, local := range append([]string{config.Host}, config.Domains...) {
+				if strings.EqualFold(domain, local) {
+					problems = append(problems, errors.New("Postmaster "+config.Postmaster+" is in local domain "+local+", postmaster@ mail would loop"))
+					break
+				}
+			}
+		}
+	}
+
+	switch config.ProtocolPolicy {
+	case "", "log", "penalize", "disconnect":
+	default:
+		problems = append(problems, errors.New("invalid ProtocolPolicy "+config.ProtocolPolicy+", need log, penalize or disconnect"))
+	}
+
+	if refresh <= 0 {
+		problems = append(problems, fmt.Errorf("refresh time must be positive, got %d", refresh))
+	}
+
+	// with WaitReady, relayd waits for alias URLs to come up, so one that
+	// is still down at startup isn't a problem
+	probe := config.WaitReady == ""
+	for _, source := range sources {
+		if err := checkAliasSource(source, probe); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// checkAliasSource verifies an alias file is readable, or that an alias URL
+// is well formed and, with probe, that its host accepts connections.
+func checkAliasSource(source string, probe bool) error {
+	if path, ok := aliasFile(source); ok {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot read alias file: %v", err)
+		}
+		file.Close()
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid alias url " + source)
+	}
+	if !probe {
+		return nil
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = u.Scheme
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("alias url %s is unreachable: %v", source, err)
+	}
+	conn.Close()
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// hasProblem reports whether validateConfig found a problem mentioning text.
+func hasProblem(config Config, sources []string, text string) bool {
+	for _, problem := range validateConfig(config, sources, 300) {
+		if strings.Contains(problem.Error(), text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateHeaderlessPolicy(t *testing.T) {
+	for policy, valid := range map[string]bool{
+		"":           true,
+		"reject":     true,
+		"synthesize": true,
+		"synthesise": false,
+	} {
+		config := Config{Port: "25", HeaderlessPolicy: policy}
+		if hasProblem(config, nil, "HeaderlessPolicy") == valid {
+			t.Errorf("HeaderlessPolicy %q: valid = %v, want %v", policy, !valid, valid)
+		}
+	}
+}
+
+func TestValidateRetrySchedules(t *testing.T) {
+	for spec, valid := range map[string]bool{
+		"30,60,300": true,
+		"60":        true,
+		"30,1m":     false,
+		"0,60":      false,
+	} {
+		config := Config{Port: "25", RetrySchedules: map[string]string{"partner.example": spec}}
+		if hasProblem(config, nil, "retry schedule") == valid {
+			t.Errorf("RetrySchedules %q: valid = %v, want %v", spec, !valid, valid)
+		}
+	}
+}
+
+func TestValidateDeliveryDeadline(t *testing.T) {
+	for _, test := range []struct {
+		deadline string
+		queue    string
+		valid    bool
+	}{
+		{"30", "/var/spool/relayd", true},
+		{"30", "", false},
+		{"0", "/var/spool/relayd", false},
+		{"30s", "/var/spool/relayd", false},
+	} {
+		config := Config{Port: "25", DeliveryDeadline: test.deadline, QueueDir: test.queue}
+		if hasProblem(config, nil, "DeliveryDeadline") == test.valid {
+			t.Errorf("DeliveryDeadline %q with QueueDir %q: valid = %v, want %v", test.deadline, test.queue, !test.valid, test.valid)
+		}
+	}
+}
+
+func TestValidateMinFreeSpace(t *testing.T) {
+	for _, test := range []struct {
+		space string
+		queue string
+		valid bool
+	}{
+		{"512", "/var/spool/relayd", true},
+		{"512", "", false},
+		{"-1", "/var/spool/relayd", false},
+		{"1G", "/var/spool/relayd", false},
+	} {
+		config := Config{Port: "25", MinFreeSpace: test.space, QueueDir: test.queue}
+		if hasProblem(config, nil, "MinFreeSpace") == test.valid {
+			t.Errorf("MinFreeSpace %q with QueueDir %q: valid = %v, want %v", test.space, test.queue, !test.valid, test.valid)
+		}
+	}
+}
+
+func TestValidateAliasURLWithWaitReady(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + listener.Addr().String() + "/aliases"
+	listener.Close()
+
+	if !hasProblem(Config{Port: "25"}, []string{down}, "unreachable") {
+		t.Error("unreachable alias url passed validation without WaitReady")
+	}
+	if hasProblem(Config{Port: "25", WaitReady: "60"}, []string{down}, "unreachable") {
+		t.Error("alias url probed at startup despite WaitReady")
+	}
+	if !hasProblem(Config{Port: "25", WaitReady: "60"}, []string{"ftp://example.com/aliases"}, "invalid alias url") {
+		t.Error("malformed alias url passed validation with WaitReady")
+	}
+}
+
+func TestValidateMaxBounces(t *testing.T) {
+	for _, test := range []struct {
+		max    string
+		window string
+		queue  string
+		valid  bool
+	}{
+		{"5", "", "/var/spool/relayd", true},
+		{"5", "600", "/var/spool/relayd", true},
+		{"5", "", "", false},
+		{"0", "", "/var/spool/relayd", false},
+		{"5", "10m", "/var/spool/relayd", false},
+		{"", "600", "/var/spool/relayd", false},
+	} {
+		config := Config{Port: "25", MaxBounces: test.max, BounceWindow: test.window, QueueDir: test.queue}
+		if hasProblem(config, nil, "Bounce") == test.valid {
+			t.Errorf("MaxBounces %q, BounceWindow %q with QueueDir %q: valid = %v, want %v", test.max, test.window, test.queue, !test.valid, test.valid)
+		}
+	}
+}
+
+func TestValidatePostmaster(t *testing.T) {
+	for postmaster, valid := range map[string]bool{
+		"":                true,
+		"ops@example.org": true,
+		"root@mx.example": false,
+		"ops@Example.COM": false,
+		"postmaster":      false,
+	} {
+		config := Config{Port: "25", Host: "mx.example", Domains: []string{"example.com"}, Postmaster: postmaster}
+		if hasProblem(config, nil, "Postmaster") == valid {
+			t.Errorf("Postmaster %q: valid = %v, want %v", postmaster, !valid, valid)
+		}
+	}
+}
+
+func TestValidateQuarantineScore(t *testing.T) {
+	for _, test := range []struct {
+		score  string
+		header string
+		queue  string
+		valid  bool
+	}{
+		{"5", "", "/var/spool/relayd", true},
+		{"7.5", "X-Rspamd-Score", "/var/spool/relayd", true},
+		{"5", "", "", false},
+		{"0", "", "/var/spool/relayd", false},
+		{"high", "", "/var/spool/relayd", false},
+		{"", "X-Spam-Score", "/var/spool/relayd", false},
+	} {
+		config := Config{Port: "25", QuarantineScore: test.score, ScoreHeader: test.header, QueueDir: test.queue}
+		if hasProblem(config, nil, "QuarantineScore") == test.valid {
+			t.Errorf("QuarantineScore %q, ScoreHeader %q with QueueDir %q: valid = %v, want %v", test.score, test.header, test.queue, !test.valid, test.valid)
+		}
+	}
+}
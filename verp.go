@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+)
+
+// encodeVERP encodes recipient into the bounce address base, so that
+// bounces+user=example.com@relay.example.com identifies user@example.com.
+func encodeVERP(base string, recipient string) string {
+	ix := strings.LastIndex(base, "@")
+	if ix < 0 {
+		return base
+	}
+	return base[:ix] + "+" + strings.Replace(recipient, "@", "=", -1) + base[ix:]
+}
+
+// decodeVERP returns the recipient encoded in addr, or false when addr is
+// not a VERP address for base.
+func decodeVERP(base string, addr string) (string, bool) {
+	ix := strings.LastIndex(base, "@")
+	if ix < 0 {
+		return "", false
+	}
+
+	prefix := strings.ToLower(base[:ix] + "+")
+	suffix := strings.ToLower(base[ix:])
+	lower := strings.ToLower(addr)
+	if !strings.HasPrefix(lower, prefix) || !strings.HasSuffix(lower, suffix) || len(addr) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+
+	encoded := addr[len(prefix) : len(addr)-len(suffix)]
+	eq := strings.LastIndex(encoded, "=")
+	if eq <= 0 || eq == len(encoded)-1 {
+		return "", false
+	}
+
+	return encoded[:eq] + "@" + encoded[eq+1:], true
+}
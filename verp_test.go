@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVERPRoundTrip(t *testing.T) {
+	base := "bounces@relay.example.com"
+	for _, test := range []struct {
+		recipient string
+		encoded   string
+	}{
+		{"user@example.com", "bounces+user=example.com@relay.example.com"},
+		{"first.last+tag@example.org", "bounces+first.last+tag=example.org@relay.example.com"},
+		{"a=b@example.net", "bounces+a=b=example.net@relay.example.com"},
+	} {
+		encoded := encodeVERP(base, test.recipient)
+		if encoded != test.encoded {
+			t.Errorf("encodeVERP(%q) = %q, want %q", test.recipient, encoded, test.encoded)
+		}
+		recipient, ok := decodeVERP(base, encoded)
+		if !ok || recipient != test.recipient {
+			t.Errorf("decodeVERP(%q) = %q, %v, want %q", encoded, recipient, ok, test.recipient)
+		}
+	}
+
+	if recipient, ok := decodeVERP(base, "BOUNCES+User=Example.com@Relay.Example.com"); !ok || recipient != "User@Example.com" {
+		t.Errorf("decodeVERP ignoring case gave %q, %v", recipient, ok)
+	}
+	for _, addr := range []string{"bounces@relay.example.com", "bounces+user@relay.example.com", "other+user=example.com@relay.example.com", "bounces+user=example.com@elsewhere.example.com"} {
+		if recipient, ok := decodeVERP(base, addr); ok {
+			t.Errorf("decodeVERP(%q) = %q, want no VERP address", addr, recipient)
+		}
+	}
+}
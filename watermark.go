@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"log"
+	"sync"
+	"time"
+)
+
+// diskWatermark watches the free space on the spool's filesystem. Below
+// min bytes relayd defers new mail with a 452 until space recovers, while
+// the queue keeps draining.
+type diskWatermark struct {
+	sync.Mutex
+	dir  string
+	min  uint64
+	free uint64
+	low  bool
+}
+
+func newDiskWatermark(dir string, min uint64) *diskWatermark {
+	d := &diskWatermark{dir: dir, min: min}
+	d.Check()
+	return d
+}
+
+// Run checks the free space every interval.
+func (d *diskWatermark) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.Check()
+	}
+}
+
+// Check measures the free space, logging when it crosses the watermark. A
+// failed measurement leaves the last state in place.
+func (d *diskWatermark) Check() {
+	free, err := freeSpace(d.dir)
+	if err != nil {
+		log.Println("failed to check free space in "+d.dir, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	low := free < d.min
+	if low && !d.low {
+		log.Printf("ALERT: %d bytes free in %s, below %d, deferring new mail", free, d.dir, d.min)
+	} else if !low && d.low {
+		log.Printf("%d bytes free in %s, accepting mail again", free, d.dir)
+	}
+	d.free, d.low = free, low
+
+	spool_free_bytes.Set(float64(free))
+	if low {
+		spool_low.Set(1)
+	} else {
+		spool_low.Set(0)
+	}
+}
+
+// Accept returns the reply deferring a recipient while space is low. A nil
+// watermark always accepts.
+func (d *diskWatermark) Accept() error {
+	if d == nil {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.low {
+		return smtpd.Error{Code: 452, Message: "4.3.1 Insufficient system storage"}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bitbucket.org/chrj/smtpd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskWatermarkDefersNewMail(t *testing.T) {
+	logged := captureLog(t)
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// more free space wanted than the filesystem can have
+	disk := newDiskWatermark(dir, free+1<<40)
+	err = disk.Accept()
+	if smtpErr, ok := err.(smtpd.Error); !ok || smtpErr.Code != 452 || smtpErr.Message != "4.3.1 Insufficient system storage" {
+		t.Errorf("recipient below the watermark: got %v, want 452 4.3.1", err)
+	}
+
+	aliases := &AliasSet{Backends: []*AliasBackend{testBackend("primary", Alias{Source: "info@example.com"})}}
+	health := httptest.NewRecorder()
+	healthz(aliases, time.Hour, disk)(health, httptest.NewRequest("GET", "/healthz", nil))
+	if health.Code != http.StatusServiceUnavailable {
+		t.Errorf("health check below the watermark answered %d, want 503", health.Code)
+	}
+
+	// space recovers
+	disk.min = 1
+	disk.Check()
+	if err := disk.Accept(); err != nil {
+		t.Errorf("recipient after space recovered: got %v", err)
+	}
+	health = httptest.NewRecorder()
+	healthz(aliases, time.Hour, disk)(health, httptest.NewRequest("GET", "/healthz", nil))
+	if health.Code != http.StatusOK {
+		t.Errorf("health check after space recovered answered %d, want 200", health.Code)
+	}
+	if !strings.Contains(logged.String(), "deferring new mail") || !strings.Contains(logged.String(), "accepting mail again") {
+		t.Errorf("log %q lacks the watermark crossings", logged.String())
+	}
+
+	var unset *diskWatermark
+	if err := unset.Accept(); err != nil {
+		t.Errorf("recipient without MinFreeSpace: got %v", err)
+	}
+}